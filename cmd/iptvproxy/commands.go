@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/proxy"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+)
+
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file, defaults to ./iptvproxy_config.yaml")
+	listen := fs.String("listen", "", "address to listen on, e.g. :1338 or 127.0.0.1:8080, overrides server.listen")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error, overrides app.logLevel")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return 2
+	}
+
+	config.SetConfigFile(*configFile)
+	if *listen != "" {
+		config.Set("server.listen", *listen)
+	}
+	if *logLevel != "" {
+		config.Set("app.logLevel", *logLevel)
+	}
+	if err := config.Load(); err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+
+	// secrets like tokens and list urls are masked
+	logger.Info("App started, config:\n  " + strings.Join(config.Describe(config.GetConfig()), "\n  "))
+
+	// first signal starts graceful shutdown, second one kills the app
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	config.Watch()
+	if err := proxy.InitServer(ctx); err != nil {
+		logger.Error("Server failed: " + err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file, defaults to ./iptvproxy_config.yaml")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return 2
+	}
+
+	config.SetConfigFile(*configFile)
+	c, err := config.Read()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read config: "+err.Error())
+		return 1
+	}
+	if err := config.Validate(c); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println("Config is valid")
+	return 0
+}
+
+func runEncode(args []string) int {
+	fs := flag.NewFlagSet("encode", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file, defaults to ./iptvproxy_config.yaml")
+	listName := fs.String("list", "", "name of list the url belongs to")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return 2
+	}
+	if *listName == "" {
+		fmt.Fprintln(os.Stderr, "Missing --list")
+		return 2
+	}
+	if !loadConfig(*configFile) {
+		return 1
+	}
+	if _, err := config.GetListFromConfig(*listName); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	proxyURL, err := urlconvert.ConvertURLtoProxyURL(positional[0], config.GetConfig().App.URL, *listName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to convert url: "+err.Error())
+		return 1
+	}
+	fmt.Println(proxyURL)
+	return 0
+}
+
+func runDecode(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file, defaults to ./iptvproxy_config.yaml")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return 2
+	}
+	if !loadConfig(*configFile) {
+		return 1
+	}
+
+	realURL, listName, err := urlconvert.ConvertProxyURLtoURL(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to convert url: "+err.Error())
+		return 1
+	}
+	fmt.Println(realURL)
+	fmt.Fprintln(os.Stderr, "List: "+listName)
+	return 0
+}
+
+func runGenToken(args []string) int {
+	fs := flag.NewFlagSet("gen-token", flag.ContinueOnError)
+	size := fs.Int("bytes", 24, "number of random bytes in token")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return 2
+	}
+	if *size < 8 {
+		fmt.Fprintln(os.Stderr, "Token should have at least 8 bytes")
+		return 2
+	}
+
+	b := make([]byte, *size)
+	if _, err := rand.Read(b); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to generate token: "+err.Error())
+		return 1
+	}
+	fmt.Println(base64.RawURLEncoding.EncodeToString(b))
+	return 0
+}
+
+func runDumpList(args []string) int {
+	fs := flag.NewFlagSet("dump-list", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file, defaults to ./iptvproxy_config.yaml")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return 2
+	}
+	if !loadConfig(*configFile) {
+		return 1
+	}
+	// keep stderr readable, every converted url is logged on debug level
+	logger.SetLevel("warn")
+
+	if err := proxy.DumpList(positional[0], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to dump list: "+err.Error())
+		return 1
+	}
+	return 0
+}
+
+func loadConfig(configFile string) bool {
+	config.SetConfigFile(configFile)
+	if err := config.Load(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return false
+	}
+	return true
+}
+
+// parseArgs parses flags placed before or after positional arguments
+// and checks that exactly expected number of positional arguments was given
+func parseArgs(fs *flag.FlagSet, args []string, expected int) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) != expected {
+		err := fmt.Errorf("%s expects %d argument(s), got %d", fs.Name(), expected, len(positional))
+		fmt.Fprintln(os.Stderr, err.Error())
+		fs.Usage()
+		return nil, err
+	}
+	return positional, nil
+}
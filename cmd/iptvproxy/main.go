@@ -1,17 +1,58 @@
 package main
 
 import (
-	"log"
-
-	"github.com/nortoneo/iptv-proxy/internal/config"
-	"github.com/nortoneo/iptv-proxy/internal/proxy"
+	"fmt"
+	"os"
+	"strings"
 )
 
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "serve [--config FILE] [--listen ADDR] [--log-level LEVEL]", "start proxy server (default)", runServe},
+		{"validate", "validate [--config FILE]", "check config and report all problems", runValidate},
+		{"encode", "encode [--config FILE] --list NAME URL", "convert real url to proxy url", runEncode},
+		{"decode", "decode [--config FILE] PROXY_URL", "convert proxy url to real url", runDecode},
+		{"gen-token", "gen-token [--bytes N]", "generate random list token", runGenToken},
+		{"dump-list", "dump-list [--config FILE] NAME", "print rewritten playlist of list", runDumpList},
+		{"help", "help", "show this help", runHelp},
+	}
+}
+
 func main() {
-	c := config.GetConfig()
-	log.Printf(
-		"App started\nApp config: %+v\nServer config: %+v\nClient config: %+v\nPlaylists: %+v",
-		c.App, c.Server, c.Client, c.Lists)
+	// running without command starts server to keep existing deployments working
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runServe(os.Args[1:]))
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Unknown command "+os.Args[1])
+	printUsage()
+	os.Exit(2)
+}
+
+func runHelp(args []string) int {
+	printUsage()
+	return 0
+}
 
-	proxy.InitServer()
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: iptv-proxy COMMAND [OPTIONS]\n\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-60s %s\n", cmd.usage, cmd.description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun iptv-proxy COMMAND --help to see command options.")
 }
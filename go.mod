@@ -3,15 +3,16 @@ module github.com/nortoneo/iptv-proxy
 go 1.19
 
 require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/mux v1.8.0
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/spf13/viper v1.7.1
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.4.7 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.1 // indirect
-	github.com/mitchellh/mapstructure v1.1.2 // indirect
 	github.com/pelletier/go-toml v1.2.0 // indirect
 	github.com/spf13/afero v1.1.2 // indirect
 	github.com/spf13/cast v1.3.0 // indirect
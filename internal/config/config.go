@@ -8,38 +8,252 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nortoneo/iptv-proxy/internal/logger"
 	"github.com/spf13/viper"
 )
 
+// DefaultPassthroughHeaders are client headers forwarded to provider when list doesn't configure them,
+// byte ranges let players seek in movies
+var DefaultPassthroughHeaders = []string{"User-Agent", "Range", "If-Range"}
+
+// DefaultAllowedResponseHeaders are provider response headers forwarded to clients by default
+var DefaultAllowedResponseHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Range", "Content-Encoding", "Content-Disposition", "Content-Language",
+	"Accept-Ranges", "Cache-Control", "Expires", "Last-Modified", "ETag", "Age", "Vary", "Access-Control-*",
+}
+
+// DefaultDeniedResponseHeaders are provider response headers never forwarded to clients by default
+var DefaultDeniedResponseHeaders = []string{"Set-Cookie", "Strict-Transport-Security", "Alt-Svc"}
+
+// DefaultCORSMethods, DefaultCORSHeaders and DefaultCORSExposedHeaders are used when list enables CORS without setting them
+var (
+	DefaultCORSMethods        = []string{"GET", "HEAD", "OPTIONS"}
+	DefaultCORSHeaders        = []string{"Range", "Accept", "Content-Type"}
+	DefaultCORSExposedHeaders = []string{"Content-Length", "Content-Range", "Accept-Ranges", "Content-Type"}
+)
+
 var c *Config
+var configFile string
+var overrides = make(map[string]interface{})
+
+// watched is viper instance which read config on start, it is used only to watch config file
+var watched *viper.Viper
+var initErr error
 var once sync.Once
+var mu sync.RWMutex
+var reloadMu sync.Mutex
+var changeListeners []func(old, new Config)
 
 const (
 	envKeyList           = "LIST_"
 	envKeyToken          = "TOKEN_"
 	envKeyMaxConnections = "MAXCON_"
+	envKeyProxy          = "PROXY_"
 )
 
 // List struct
 type List struct {
-	Token          string `mapstructure:"token"`
-	URL            string `mapstructure:"url"`
-	MaxConnections int    `mapstructure:"maxConnections"`
+	Token           string          `mapstructure:"token"`
+	URL             string          `mapstructure:"url"`
+	MaxConnections  int             `mapstructure:"maxConnections"`
+	Proxy           string          `mapstructure:"proxy"`
+	TLS             UpstreamTLS     `mapstructure:"tls"`
+	Headers         UpstreamHeaders `mapstructure:"headers"`
+	Cookies         Cookies         `mapstructure:"cookies"`
+	ResponseHeaders HeaderPolicy    `mapstructure:"responseHeaders"`
+	CORS            CORS            `mapstructure:"cors"`
+	Content         ContentRules    `mapstructure:"content"`
+	Variants        Variants        `mapstructure:"variants"`
+	Probe           ChannelProbe    `mapstructure:"probe"`
+	// EPG is url of XMLTV guide, url-tvg attribute of playlist is used when it is empty
+	EPG string `mapstructure:"epg"`
+	// CatchupTimezone is IANA zone of date placeholders in catch-up urls and of Xtream timeshift urls, UTC when empty
+	CatchupTimezone string `mapstructure:"catchupTimezone"`
+}
+
+// ChannelProbe struct, enables background probing of list channels.
+// Dead channels can be kept, hidden or moved to offlineGroup (Offline by default) of rewritten playlists.
+type ChannelProbe struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	DeadChannels string `mapstructure:"deadChannels"`
+	OfflineGroup string `mapstructure:"offlineGroup"`
+}
+
+// Variants struct, filters variants of HLS master playlists so players can't pick ones too big for their connection.
+// The first profile matching client replaces filter of the list.
+type Variants struct {
+	VariantFilter `mapstructure:",squash"`
+	Profiles      []VariantProfile `mapstructure:"profiles"`
+}
+
+// VariantFilter struct, empty values don't filter. Codecs are prefixes like avc1 or mp4a,
+// single keeps only the highest or the lowest of remaining variants, or the one nearest to maxBandwidth and maxResolution.
+type VariantFilter struct {
+	MaxBandwidth  int      `mapstructure:"maxBandwidth"`
+	MaxResolution string   `mapstructure:"maxResolution"`
+	Codecs        []string `mapstructure:"codecs"`
+	Single        string   `mapstructure:"single"`
+}
+
+// VariantProfile struct, filter for clients with address in one of clients (ip or CIDR)
+// and user agent containing one of userAgents (case insensitive), empty condition matches any client.
+type VariantProfile struct {
+	Clients       []string `mapstructure:"clients"`
+	UserAgents    []string `mapstructure:"userAgents"`
+	VariantFilter `mapstructure:",squash"`
+}
+
+// ContentRules struct, overrides detection if response should be parsed or streamed.
+// Rules starting with dot match path extension, others match content type, * at the end matches any suffix.
+type ContentRules struct {
+	Parse  []string `mapstructure:"parse"`
+	Stream []string `mapstructure:"stream"`
+}
+
+// CORS struct, cross origin policy for browser based players, disabled when no origin is allowed
+type CORS struct {
+	AllowedOrigins   []string      `mapstructure:"allowedOrigins"`
+	AllowedMethods   []string      `mapstructure:"allowedMethods"`
+	AllowedHeaders   []string      `mapstructure:"allowedHeaders"`
+	ExposedHeaders   []string      `mapstructure:"exposedHeaders"`
+	AllowCredentials bool          `mapstructure:"allowCredentials"`
+	MaxAge           time.Duration `mapstructure:"maxAge"`
+}
+
+// HeaderPolicy struct, lists of forwarded and dropped headers.
+// Names are case insensitive, * at the end matches any suffix, deny wins over allow.
+type HeaderPolicy struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+// UpstreamHeaders struct, headers of requests to list provider.
+// Values of set and add can contain placeholders {client_ip}, {user_agent} and {list}.
+type UpstreamHeaders struct {
+	UserAgent   string            `mapstructure:"userAgent"`
+	Set         map[string]string `mapstructure:"set"`
+	Add         map[string]string `mapstructure:"add"`
+	Remove      []string          `mapstructure:"remove"`
+	Passthrough []string          `mapstructure:"passthrough"`
+}
+
+// Cookies struct, cookies sent to list provider.
+// Values are written as name=value, map isn't used because config keys are case insensitive.
+type Cookies struct {
+	Jar      bool     `mapstructure:"jar"`
+	LoginURL string   `mapstructure:"loginURL"`
+	Values   []string `mapstructure:"values"`
+}
+
+// UpstreamTLS struct, settings of tls connections to list provider
+type UpstreamTLS struct {
+	Verify       bool     `mapstructure:"verify"`
+	CAFile       string   `mapstructure:"caFile"`
+	Fingerprints []string `mapstructure:"fingerprints"`
+	ServerName   string   `mapstructure:"serverName"`
 }
 
 // App struct
 type App struct {
-	EncryptionKey string `mapstructure:"encryptionKey"`
-	URL           string `mapstructure:"url"`
+	EncryptionKey             string `mapstructure:"encryptionKey"`
+	AllowDefaultEncryptionKey bool   `mapstructure:"allowDefaultEncryptionKey"`
+	URL                       string `mapstructure:"url"`
+	LogLevel                  string `mapstructure:"logLevel"`
 }
 
 // Server struct
 type Server struct {
-	Port                         int           `mapstructure:"port"`
-	WriteTimeout                 time.Duration `mapstructure:"writeTimeout"`
-	ReadTimeout                  time.Duration `mapstructure:"readTimeout"`
-	IdleTimeout                  time.Duration `mapstructure:"idleTimeout"`
-	WaitForConnectionSlotTimeout time.Duration `mapstructure:"waitForConnectionSlotTimeout"`
+	Port                         int            `mapstructure:"port"`
+	Listen                       string         `mapstructure:"listen"`
+	WriteTimeout                 time.Duration  `mapstructure:"writeTimeout"`
+	ReadTimeout                  time.Duration  `mapstructure:"readTimeout"`
+	IdleTimeout                  time.Duration  `mapstructure:"idleTimeout"`
+	WaitForConnectionSlotTimeout time.Duration  `mapstructure:"waitForConnectionSlotTimeout"`
+	HLSSessionTimeout            time.Duration  `mapstructure:"hlsSessionTimeout"`
+	ShutdownTimeout              time.Duration  `mapstructure:"shutdownTimeout"`
+	TLS                          TLS            `mapstructure:"tls"`
+	ResponseHeaders              HeaderPolicy   `mapstructure:"responseHeaders"`
+	RewriteBufferSize            ByteSize       `mapstructure:"rewriteBufferSize"`
+	Compression                  Compression    `mapstructure:"compression"`
+	SegmentCache                 SegmentCache   `mapstructure:"segmentCache"`
+	Repackage                    Repackage      `mapstructure:"repackage"`
+	DVR                          DVR            `mapstructure:"dvr"`
+	Recordings                   Recordings     `mapstructure:"recordings"`
+	Probe                        Probe          `mapstructure:"probe"`
+	CircuitBreaker               CircuitBreaker `mapstructure:"circuitBreaker"`
+	Metrics                      Metrics        `mapstructure:"metrics"`
+}
+
+// CircuitBreaker struct, requests to provider host fail fast after failures consecutive connection failures.
+// Host is tried again by single request after openTimeout, which doubles up to maxOpenTimeout while host keeps failing.
+// Disabled when failures is 0, default is 5.
+type CircuitBreaker struct {
+	Failures       int           `mapstructure:"failures"`
+	OpenTimeout    time.Duration `mapstructure:"openTimeout"`
+	MaxOpenTimeout time.Duration `mapstructure:"maxOpenTimeout"`
+}
+
+// Metrics struct, Prometheus metrics served by /metrics, token parameter is required when token is set
+type Metrics struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Token   string `mapstructure:"token"`
+}
+
+// Probe struct, background probing of channels of lists which enable it. Each list is probed every interval,
+// at most slots channels at once and only when list has free connection slot, so viewers aren't starved.
+// Last history results of each channel are kept.
+type Probe struct {
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Slots    int           `mapstructure:"slots"`
+	History  int           `mapstructure:"history"`
+}
+
+// Recordings struct, scheduled recordings of channels written to dir, disabled when dir is empty.
+// Recording which fails is retried after retryDelay at most retries times until its stop time.
+type Recordings struct {
+	Dir        string        `mapstructure:"dir"`
+	Retries    int           `mapstructure:"retries"`
+	RetryDelay time.Duration `mapstructure:"retryDelay"`
+}
+
+// DVR struct, rolling disk buffer of repackaged channels served by /dvr/{list}/{channel}.m3u8, disabled when dir is empty.
+// Buffer of channel is kept until nobody requests it for idleTimeout.
+type DVR struct {
+	Dir         string        `mapstructure:"dir"`
+	Duration    time.Duration `mapstructure:"duration"`
+	MaxSize     ByteSize      `mapstructure:"maxSize"`
+	IdleTimeout time.Duration `mapstructure:"idleTimeout"`
+}
+
+// Repackage struct, live MPEG-TS channels repackaged to HLS served by /hls/{list}/{channel}.m3u8
+type Repackage struct {
+	SegmentDuration time.Duration `mapstructure:"segmentDuration"`
+	PlaylistSize    int           `mapstructure:"playlistSize"`
+	IdleTimeout     time.Duration `mapstructure:"idleTimeout"`
+}
+
+// SegmentCache struct, memory cache of HLS segments shared by viewers of the same channel, size 0 disables it
+type SegmentCache struct {
+	Size           ByteSize `mapstructure:"size"`
+	MaxSegmentSize ByteSize `mapstructure:"maxSegmentSize"`
+}
+
+// Compression struct, compression of rewritten playlists and epg negotiated by client Accept-Encoding header
+type Compression struct {
+	Enabled bool `mapstructure:"enabled"`
+	Brotli  bool `mapstructure:"brotli"`
+}
+
+// TLS struct
+type TLS struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	Port         int    `mapstructure:"port"`
+	Listen       string `mapstructure:"listen"`
+	CertFile     string `mapstructure:"certFile"`
+	KeyFile      string `mapstructure:"keyFile"`
+	SelfSigned   bool   `mapstructure:"selfSigned"`
+	RedirectHTTP bool   `mapstructure:"redirectHTTP"`
 }
 
 // Client struct
@@ -60,12 +274,52 @@ type Config struct {
 	Client Client          `mapstructure:"client"`
 }
 
-// GetConfig returns initialized config struct
-func GetConfig() Config {
+// SetConfigFile sets path of config file, it has to be called before config is loaded.
+// By default iptvproxy_config.yaml is looked up in working directory.
+func SetConfigFile(path string) {
+	configFile = path
+}
+
+// Set overrides config value by its key, it has to be called before config is loaded
+func Set(key string, value interface{}) {
+	overrides[key] = value
+}
+
+// GetListenAddress returns address server should listen on
+func GetListenAddress() string {
+	s := GetConfig().Server
+	if s.Listen != "" {
+		return s.Listen
+	}
+	return ":" + strconv.Itoa(s.Port)
+}
+
+// GetTLSListenAddress returns address https server should listen on
+func GetTLSListenAddress() string {
+	t := GetConfig().Server.TLS
+	if t.Listen != "" {
+		return t.Listen
+	}
+	return ":" + strconv.Itoa(t.Port)
+}
+
+// Load initializes config and returns error if it can't be read or is invalid
+func Load() error {
 	once.Do(func() {
-		initConfig()
+		initErr = initConfig()
 	})
 
+	return initErr
+}
+
+// GetConfig returns initialized config struct, it panics if config is invalid
+func GetConfig() Config {
+	if err := Load(); err != nil {
+		panic(err)
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
 	return *c
 }
 
@@ -98,55 +352,141 @@ func GetListFromConfig(name string) (List, error) {
 	return List{}, errors.New("List " + name + " doesn`t exist")
 }
 
-func initConfig() {
-	config := Config{}
+// Read reads config without validating and storing it
+func Read() (Config, error) {
+	return readConfig(newViper())
+}
 
-	viper.SetDefault("server.port", 1338)
-	viper.SetDefault("app.url", "http://127.0.0.1:1338")
-	viper.SetDefault("app.encryptionKey", "some_key")
-	viper.SetDefault("client.dialTimeout", "1m")
-	viper.SetDefault("client.dialKeepalive", "5m")
-	viper.SetDefault("client.tlsHandshakeTimeout", "30s")
-	viper.SetDefault("client.responseHeaderTimeout", "30s")
-	viper.SetDefault("client.expectContinueTimeout", "5s")
-	viper.SetDefault("client.timeout", "5m")
-	viper.SetDefault("server.writeTimeout", "5m")
-	viper.SetDefault("server.readTimeout", "5m")
-	viper.SetDefault("server.idleTimeout", "5m")
-	viper.SetDefault("server.waitForConnectionSlotTimeout", "1s")
-
-	path := "."
-	viper.AddConfigPath(path)
-	viper.SetConfigName("iptvproxy_config")
-	viper.SetConfigType("yaml")
-
-	viper.SafeWriteConfig()
+func initConfig() error {
+	v := newViper()
+	config, err := readConfig(v)
+	if err != nil {
+		return err
+	}
+	err = Validate(config)
+	if err != nil {
+		return err
+	}
+
+	c = &config
+	watched = v
+	logger.SetLevel(config.App.LogLevel)
+	return nil
+}
+
+// newViper returns viper instance with defaults, config file and env settings, each read of config gets its own
+// instance because viper isn't safe for concurrent use
+func newViper() *viper.Viper {
+	v := viper.New()
+	v.SetDefault("server.port", 1338)
+	v.SetDefault("server.listen", "")
+	v.SetDefault("app.url", "http://127.0.0.1:1338")
+	v.SetDefault("app.encryptionKey", DefaultEncryptionKey)
+	v.SetDefault("app.logLevel", "info")
+	v.SetDefault("client.dialTimeout", "1m")
+	v.SetDefault("client.dialKeepalive", "5m")
+	v.SetDefault("client.tlsHandshakeTimeout", "30s")
+	v.SetDefault("client.responseHeaderTimeout", "30s")
+	v.SetDefault("client.expectContinueTimeout", "5s")
+	v.SetDefault("client.timeout", "5m")
+	v.SetDefault("server.writeTimeout", "5m")
+	v.SetDefault("server.readTimeout", "5m")
+	v.SetDefault("server.idleTimeout", "5m")
+	v.SetDefault("server.waitForConnectionSlotTimeout", "1s")
+	v.SetDefault("server.hlsSessionTimeout", "30s")
+	v.SetDefault("server.shutdownTimeout", "5s")
+	v.SetDefault("server.responseHeaders.allow", DefaultAllowedResponseHeaders)
+	v.SetDefault("server.responseHeaders.deny", DefaultDeniedResponseHeaders)
+	v.SetDefault("server.rewriteBufferSize", "4MB")
+	v.SetDefault("server.compression.enabled", true)
+	v.SetDefault("server.compression.brotli", true)
+	v.SetDefault("server.segmentCache.size", "64MB")
+	v.SetDefault("server.segmentCache.maxSegmentSize", "16MB")
+	v.SetDefault("server.repackage.segmentDuration", "4s")
+	v.SetDefault("server.repackage.playlistSize", 6)
+	v.SetDefault("server.repackage.idleTimeout", "30s")
+	v.SetDefault("server.dvr.dir", "")
+	v.SetDefault("server.dvr.duration", "30m")
+	v.SetDefault("server.dvr.maxSize", "2GB")
+	v.SetDefault("server.dvr.idleTimeout", "10m")
+	v.SetDefault("server.recordings.dir", "")
+	v.SetDefault("server.recordings.retries", 5)
+	v.SetDefault("server.recordings.retryDelay", "10s")
+	v.SetDefault("server.probe.interval", "1h")
+	v.SetDefault("server.probe.timeout", "15s")
+	v.SetDefault("server.probe.slots", 1)
+	v.SetDefault("server.probe.history", 10)
+	v.SetDefault("server.circuitBreaker.failures", 5)
+	v.SetDefault("server.circuitBreaker.openTimeout", "30s")
+	v.SetDefault("server.circuitBreaker.maxOpenTimeout", "5m")
+	v.SetDefault("server.metrics.enabled", false)
+	v.SetDefault("server.metrics.token", "")
+	v.SetDefault("server.tls.enabled", false)
+	v.SetDefault("server.tls.port", 1339)
+	v.SetDefault("server.tls.listen", "")
+	v.SetDefault("server.tls.certFile", "")
+	v.SetDefault("server.tls.keyFile", "")
+	v.SetDefault("server.tls.selfSigned", false)
+	v.SetDefault("server.tls.redirectHTTP", false)
+
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+	} else {
+		path := "."
+		v.AddConfigPath(path)
+		v.SetConfigName("iptvproxy_config")
+		v.SetConfigType("yaml")
+	}
 
 	replacer := strings.NewReplacer(".", "_")
-	viper.SetEnvKeyReplacer(replacer)
-	viper.AutomaticEnv()
+	v.SetEnvKeyReplacer(replacer)
+	v.AutomaticEnv()
+	for key, value := range overrides {
+		v.Set(key, value)
+	}
+	return v
+}
 
-	err := viper.ReadInConfig()
-	if err != nil {
-		panic(err)
+func readConfig(v *viper.Viper) (Config, error) {
+	config := Config{}
+
+	// config file is optional when it wasn't set explicitly, env variables may be enough
+	err := v.ReadInConfig()
+	if _, notFound := err.(viper.ConfigFileNotFoundError); err != nil && !notFound {
+		return config, err
 	}
 
-	err = viper.Unmarshal(&config)
+	err = v.Unmarshal(&config, viper.DecodeHook(decodeHook()))
 	if err != nil {
-		panic(err)
+		return config, err
 	}
 
 	if config.Lists == nil {
 		config.Lists = make(map[string]List)
 	}
 	addEnvPlaylists(&config)
+	for k, l := range config.Lists {
+		if l.Headers.Passthrough == nil {
+			l.Headers.Passthrough = DefaultPassthroughHeaders
+		}
+		if l.CORS.AllowedMethods == nil {
+			l.CORS.AllowedMethods = DefaultCORSMethods
+		}
+		if l.CORS.AllowedHeaders == nil {
+			l.CORS.AllowedHeaders = DefaultCORSHeaders
+		}
+		if l.CORS.ExposedHeaders == nil {
+			l.CORS.ExposedHeaders = DefaultCORSExposedHeaders
+		}
+		config.Lists[k] = l
+	}
 
-	c = &config
+	return config, nil
 }
 
 func addEnvPlaylists(c *Config) {
 	for _, e := range os.Environ() {
-		if envKeyList == e[:len(envKeyList)] {
+		if strings.HasPrefix(e, envKeyList) {
 			pair := strings.SplitN(e, "=", 2)
 			name := pair[0][len(envKeyList):]
 			url := pair[1]
@@ -157,8 +497,9 @@ func addEnvPlaylists(c *Config) {
 			token := getEnv(envKeyToken+name, "")
 			maxConVal := getEnv(envKeyMaxConnections+name, "2")
 			maxCon, _ := strconv.Atoi(maxConVal)
+			proxy := getEnv(envKeyProxy+name, "")
 
-			c.Lists[name] = List{URL: url, Token: token, MaxConnections: maxCon}
+			c.Lists[name] = List{URL: url, Token: token, MaxConnections: maxCon, Proxy: proxy}
 		}
 	}
 }
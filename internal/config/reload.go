@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+const secretMask = "***"
+
+// secretPaths are config values which can carry credentials, * matches any list or header name
+var secretPaths = [...]string{
+	"app.encryptionKey",
+	"server.metrics.token",
+	"lists.*.token",
+	"lists.*.url",
+	"lists.*.proxy",
+	"lists.*.epg",
+	"lists.*.headers.set.*",
+	"lists.*.headers.add.*",
+	"lists.*.cookies.loginURL",
+	"lists.*.cookies.values",
+}
+
+// OnChange registers function called after config was reloaded
+func OnChange(f func(old, new Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	changeListeners = append(changeListeners, f)
+}
+
+// Watch reloads config when config file changes or SIGHUP is received
+func Watch() {
+	GetConfig()
+
+	// watcher re-reads file into its own instance, config is read again by Reload
+	if watched != nil && watched.ConfigFileUsed() != "" {
+		watched.OnConfigChange(func(e fsnotify.Event) {
+			logger.Info("Config file changed: " + e.Name)
+			if err := Reload(); err != nil {
+				logger.Error("Config reload failed: " + err.Error())
+			}
+		})
+		watched.WatchConfig()
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			logger.Info("SIGHUP received, reloading config")
+			if err := Reload(); err != nil {
+				logger.Error("Config reload failed: " + err.Error())
+			}
+		}
+	}()
+}
+
+// Reload reads config again and atomically replaces the current one.
+// Current config is kept if new one can't be read or is invalid.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newConfig, err := readConfig(newViper())
+	if err != nil {
+		return err
+	}
+	err = Validate(newConfig)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	oldConfig := *c
+	c = &newConfig
+	mu.Unlock()
+	logger.SetLevel(newConfig.App.LogLevel)
+
+	changes := Diff(oldConfig, newConfig)
+	if len(changes) == 0 {
+		logger.Info("Config reloaded, nothing changed")
+		return nil
+	}
+	logger.Info("Config reloaded, changes:\n  " + strings.Join(changes, "\n  "))
+
+	for _, f := range changeListeners {
+		f(oldConfig, newConfig)
+	}
+
+	return nil
+}
+
+// Diff returns human readable list of differences between configs, secrets are masked
+func Diff(old, new Config) []string {
+	changes := []string{}
+	diffValues("", reflect.ValueOf(old), reflect.ValueOf(new), &changes)
+	return changes
+}
+
+// Describe returns human readable list of config values, secrets are masked
+func Describe(c Config) []string {
+	lines := []string{}
+	describeValue("", reflect.ValueOf(c), &lines)
+	return lines
+}
+
+func describeValue(path string, v reflect.Value, lines *[]string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			describeValue(path, v.Elem(), lines)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			describeValue(fieldPath(path, t.Field(i)), v.Field(i), lines)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface()) })
+		for _, k := range keys {
+			describeValue(joinPath(path, fmt.Sprint(k.Interface())), v.MapIndex(k), lines)
+		}
+	default:
+		value := v.Interface()
+		if isSecretPath(path) && !v.IsZero() {
+			value = secretMask
+		}
+		*lines = append(*lines, fmt.Sprintf("%s: %v", path, value))
+	}
+}
+
+func diffValues(path string, old, new reflect.Value, changes *[]string) {
+	switch old.Kind() {
+	case reflect.Ptr:
+		if !old.IsNil() && !new.IsNil() {
+			diffValues(path, old.Elem(), new.Elem(), changes)
+			return
+		}
+		if old.IsNil() != new.IsNil() {
+			*changes = append(*changes, path+" changed")
+		}
+	case reflect.Struct:
+		t := old.Type()
+		for i := 0; i < t.NumField(); i++ {
+			diffValues(fieldPath(path, t.Field(i)), old.Field(i), new.Field(i), changes)
+		}
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, k := range old.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range new.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			k := keys[name]
+			oldVal := old.MapIndex(k)
+			newVal := new.MapIndex(k)
+			switch {
+			case !oldVal.IsValid():
+				*changes = append(*changes, joinPath(path, name)+" added")
+			case !newVal.IsValid():
+				*changes = append(*changes, joinPath(path, name)+" removed")
+			default:
+				diffValues(joinPath(path, name), oldVal, newVal, changes)
+			}
+		}
+	default:
+		if reflect.DeepEqual(old.Interface(), new.Interface()) {
+			return
+		}
+		if isSecretPath(path) {
+			*changes = append(*changes, path+" changed")
+			return
+		}
+		*changes = append(*changes, fmt.Sprintf("%s: %v -> %v", path, old.Interface(), new.Interface()))
+	}
+}
+
+// fieldPath returns config key of struct field, fields of squashed structs are keys of their parent
+func fieldPath(path string, f reflect.StructField) string {
+	name := f.Tag.Get("mapstructure")
+	if name == ",squash" {
+		return path
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return joinPath(path, name)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func isSecretPath(path string) bool {
+	names := strings.Split(path, ".")
+	for _, secret := range secretPaths {
+		if matchPath(strings.Split(secret, "."), names) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(pattern, names []string) bool {
+	if len(pattern) != len(names) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != names[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,389 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+// DefaultEncryptionKey is encryption key used when none is configured
+const DefaultEncryptionKey = "some_key"
+
+// ValidationError contains all problems found in config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks config values, returns *ValidationError listing all problems or nil
+func Validate(c Config) error {
+	v := &ValidationError{}
+
+	validateApp(c.App, v)
+	validateServer(c.Server, v)
+	validateTLS(c.Server.TLS, c.App, v)
+	validateClient(c.Client, v)
+
+	names := make([]string, 0, len(c.Lists))
+	for name := range c.Lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		validateList(name, c.Lists[name], v)
+	}
+
+	if len(v.Problems) > 0 {
+		return v
+	}
+	return nil
+}
+
+func (e *ValidationError) add(format string, a ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, a...))
+}
+
+func validateApp(a App, v *ValidationError) {
+	switch {
+	case a.EncryptionKey == "":
+		v.add("app.encryptionKey is empty")
+	case a.EncryptionKey == DefaultEncryptionKey && !a.AllowDefaultEncryptionKey:
+		v.add("app.encryptionKey has default value %q, set your own key (APP_ENCRYPTIONKEY) or set app.allowDefaultEncryptionKey to true", DefaultEncryptionKey)
+	}
+
+	if _, err := logger.ParseLevel(a.LogLevel); err != nil {
+		v.add("app.logLevel: %s", err)
+	}
+
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		v.add("app.url %q is not valid url: %s", a.URL, err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.add("app.url %q must start with http:// or https://", a.URL)
+	}
+	if u.Host == "" {
+		v.add("app.url %q has no host", a.URL)
+	}
+	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		v.add("app.url %q must not contain path, trailing slash, query or fragment", a.URL)
+	}
+}
+
+func validateServer(s Server, v *ValidationError) {
+	if s.Port < 1 || s.Port > 65535 {
+		v.add("server.port %d is out of range 1-65535", s.Port)
+	}
+	if s.Listen != "" {
+		if _, _, err := net.SplitHostPort(s.Listen); err != nil {
+			v.add("server.listen %q is not valid host:port address: %s", s.Listen, err)
+		}
+	}
+	validateNotNegative("server.writeTimeout", s.WriteTimeout, v)
+	validateNotNegative("server.readTimeout", s.ReadTimeout, v)
+	validateNotNegative("server.idleTimeout", s.IdleTimeout, v)
+	validateNotNegative("server.waitForConnectionSlotTimeout", s.WaitForConnectionSlotTimeout, v)
+	validateNotNegative("server.shutdownTimeout", s.ShutdownTimeout, v)
+	if s.HLSSessionTimeout <= 0 {
+		v.add("server.hlsSessionTimeout must be greater than 0")
+	}
+	if s.SegmentCache.Size > 0 && (s.SegmentCache.MaxSegmentSize <= 0 || s.SegmentCache.MaxSegmentSize > s.SegmentCache.Size) {
+		v.add("server.segmentCache.maxSegmentSize must be greater than 0 and not greater than server.segmentCache.size")
+	}
+	if s.Repackage.SegmentDuration < time.Second {
+		v.add("server.repackage.segmentDuration must be at least 1s")
+	}
+	if s.Repackage.PlaylistSize < 1 {
+		v.add("server.repackage.playlistSize must be at least 1")
+	}
+	if s.Repackage.IdleTimeout <= 0 {
+		v.add("server.repackage.idleTimeout must be greater than 0")
+	}
+	if s.DVR.Dir != "" {
+		if s.DVR.Duration < s.Repackage.SegmentDuration {
+			v.add("server.dvr.duration must be at least server.repackage.segmentDuration")
+		}
+		if s.DVR.MaxSize <= 0 {
+			v.add("server.dvr.maxSize must be greater than 0")
+		}
+		if s.DVR.IdleTimeout <= 0 {
+			v.add("server.dvr.idleTimeout must be greater than 0")
+		}
+	}
+	if s.Recordings.Dir != "" {
+		if s.Recordings.Retries < 0 {
+			v.add("server.recordings.retries must not be negative")
+		}
+		validateNotNegative("server.recordings.retryDelay", s.Recordings.RetryDelay, v)
+	}
+	if s.Probe.Interval <= 0 {
+		v.add("server.probe.interval must be greater than 0")
+	}
+	if s.Probe.Timeout <= 0 {
+		v.add("server.probe.timeout must be greater than 0")
+	}
+	if s.Probe.Slots < 1 {
+		v.add("server.probe.slots must be at least 1")
+	}
+	if s.Probe.History < 1 {
+		v.add("server.probe.history must be at least 1")
+	}
+	if s.CircuitBreaker.Failures < 0 {
+		v.add("server.circuitBreaker.failures must not be negative")
+	}
+	if s.CircuitBreaker.Failures > 0 {
+		if s.CircuitBreaker.OpenTimeout <= 0 {
+			v.add("server.circuitBreaker.openTimeout must be greater than 0")
+		}
+		if s.CircuitBreaker.MaxOpenTimeout < s.CircuitBreaker.OpenTimeout {
+			v.add("server.circuitBreaker.maxOpenTimeout must be at least server.circuitBreaker.openTimeout")
+		}
+	}
+}
+
+func validateTLS(t TLS, a App, v *ValidationError) {
+	if !t.Enabled {
+		return
+	}
+	if t.Port < 1 || t.Port > 65535 {
+		v.add("server.tls.port %d is out of range 1-65535", t.Port)
+	}
+	if t.Listen != "" {
+		if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+			v.add("server.tls.listen %q is not valid host:port address: %s", t.Listen, err)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		v.add("server.tls.certFile and server.tls.keyFile must be set together")
+	}
+	if t.CertFile == "" && !t.SelfSigned {
+		v.add("server.tls.certFile and server.tls.keyFile are required unless server.tls.selfSigned is true")
+	}
+	if u, err := url.Parse(a.URL); err == nil && t.RedirectHTTP && u.Scheme != "https" {
+		v.add("app.url %q must use https:// when server.tls.redirectHTTP is true", a.URL)
+	}
+}
+
+func validateClient(c Client, v *ValidationError) {
+	validateNotNegative("client.dialTimeout", c.DialTimeout, v)
+	validateNotNegative("client.dialKeepalive", c.DialKeepalive, v)
+	validateNotNegative("client.tlsHandshakeTimeout", c.TLSHandshakeTimeout, v)
+	validateNotNegative("client.responseHeaderTimeout", c.ResponseHeaderTimeout, v)
+	validateNotNegative("client.expectContinueTimeout", c.ExpectContinueTimeout, v)
+	validateNotNegative("client.timeout", c.Timeout, v)
+}
+
+func validateList(name string, l List, v *ValidationError) {
+	if l.Token == "" {
+		v.add("list %s: token is empty", name)
+	}
+	if l.MaxConnections < 1 {
+		v.add("list %s: maxConnections is %d, it must be at least 1", name, l.MaxConnections)
+	}
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		v.add("list %s: url %q is not valid url: %s", name, l.URL, err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add("list %s: url %q must be absolute http:// or https:// url", name, l.URL)
+	}
+	if l.EPG != "" {
+		if u, err := url.Parse(l.EPG); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("list %s: epg %q must be absolute http:// or https:// url", name, l.EPG)
+		}
+	}
+	switch l.Probe.DeadChannels {
+	case "", "keep", "hide", "offline":
+	default:
+		v.add("list %s: probe.deadChannels must be keep, hide or offline, got %q", name, l.Probe.DeadChannels)
+	}
+	if l.CatchupTimezone != "" {
+		if _, err := time.LoadLocation(l.CatchupTimezone); err != nil {
+			v.add("list %s: catchupTimezone %q is not valid time zone", name, l.CatchupTimezone)
+		}
+	}
+	if l.Proxy != "" {
+		p, err := url.Parse(l.Proxy)
+		switch {
+		case err != nil:
+			v.add("list %s: proxy is not valid url: %s", name, err)
+		case p.Scheme != "http" && p.Scheme != "https" && p.Scheme != "socks5":
+			v.add("list %s: proxy must be http://, https:// or socks5:// url", name)
+		case p.Host == "":
+			v.add("list %s: proxy has no host", name)
+		}
+	}
+	validateUpstreamTLS(name, l.TLS, v)
+	validateUpstreamHeaders(name, l.Headers, v)
+	validateCORS(name, l.CORS, v)
+	validateVariantFilter(name, "variants", l.Variants.VariantFilter, v)
+	for i, profile := range l.Variants.Profiles {
+		prefix := fmt.Sprintf("variants.profiles[%d]", i)
+		if len(profile.Clients) == 0 && len(profile.UserAgents) == 0 {
+			v.add("list %s: %s must set clients or userAgents", name, prefix)
+		}
+		for _, c := range profile.Clients {
+			if _, err := ParseClientNetwork(c); err != nil {
+				v.add("list %s: %s.clients: %s", name, prefix, err)
+			}
+		}
+		validateVariantFilter(name, prefix, profile.VariantFilter, v)
+	}
+	for _, cookie := range l.Cookies.Values {
+		if !strings.Contains(cookie, "=") {
+			v.add("list %s: cookie %q must be written as name=value", name, cookie)
+		}
+	}
+	if l.Cookies.LoginURL != "" {
+		if !l.Cookies.Jar {
+			v.add("list %s: cookies.loginURL requires cookies.jar to be true", name)
+		}
+		if u, err := url.Parse(l.Cookies.LoginURL); err != nil || u.Host == "" {
+			v.add("list %s: cookies.loginURL %q must be absolute url", name, l.Cookies.LoginURL)
+		}
+	}
+}
+
+func validateVariantFilter(name, prefix string, f VariantFilter, v *ValidationError) {
+	if f.MaxBandwidth < 0 {
+		v.add("list %s: %s.maxBandwidth must not be negative", name, prefix)
+	}
+	if f.MaxResolution != "" {
+		if _, _, err := ParseResolution(f.MaxResolution); err != nil {
+			v.add("list %s: %s.maxResolution: %s", name, prefix, err)
+		}
+	}
+	switch f.Single {
+	case "", "highest", "lowest":
+	case "nearest":
+		if f.MaxBandwidth == 0 && f.MaxResolution == "" {
+			v.add("list %s: %s.single nearest needs maxBandwidth or maxResolution", name, prefix)
+		}
+	default:
+		v.add("list %s: %s.single %q must be highest, lowest or nearest", name, prefix, f.Single)
+	}
+}
+
+// ParseResolution parses resolution written as WIDTHxHEIGHT
+func ParseResolution(r string) (int, int, error) {
+	var width, height int
+	parts := strings.Split(strings.ToLower(r), "x")
+	if len(parts) == 2 {
+		width, _ = strconv.Atoi(parts[0])
+		height, _ = strconv.Atoi(parts[1])
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("resolution %q must be written as WIDTHxHEIGHT", r)
+	}
+	return width, height, nil
+}
+
+// ParseClientNetwork parses client ip or CIDR network, single ip is returned as network of one address
+func ParseClientNetwork(c string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(c); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(c)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not ip or CIDR network", c)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func validateCORS(name string, c CORS, v *ValidationError) {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				v.add("list %s: cors.allowedOrigins can't contain * when cors.allowCredentials is true", name)
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			v.add("list %s: cors origin %q must be * or scheme://host[:port]", name, origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		v.add("list %s: cors.maxAge must not be negative", name)
+	}
+}
+
+// hopByHopHeaders are meaningful only for single connection and are never forwarded
+var hopByHopHeaders = [...]string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// IsHopByHopHeader reports if header is hop-by-hop header
+func IsHopByHopHeader(name string) bool {
+	for _, h := range hopByHopHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateUpstreamHeaders(name string, h UpstreamHeaders, v *ValidationError) {
+	for _, p := range h.Passthrough {
+		if IsHopByHopHeader(p) || strings.EqualFold(p, "Host") {
+			v.add("list %s: headers.passthrough can't contain %s header", name, p)
+		}
+	}
+	for k := range h.Add {
+		if IsHopByHopHeader(k) {
+			v.add("list %s: headers.add can't contain %s header", name, k)
+		}
+	}
+	for k := range h.Set {
+		if IsHopByHopHeader(k) {
+			v.add("list %s: headers.set can't contain %s header", name, k)
+		}
+	}
+}
+
+func validateUpstreamTLS(name string, t UpstreamTLS, v *ValidationError) {
+	if t.CAFile != "" {
+		if !t.Verify {
+			v.add("list %s: tls.caFile has no effect unless tls.verify is true", name)
+		}
+		if _, err := os.ReadFile(t.CAFile); err != nil {
+			v.add("list %s: tls.caFile can't be read: %s", name, err)
+		}
+	}
+	for _, f := range t.Fingerprints {
+		if _, err := ParseFingerprint(f); err != nil {
+			v.add("list %s: tls.fingerprints: %s", name, err)
+		}
+	}
+}
+
+// ParseFingerprint decodes SHA-256 certificate fingerprint written as hex, optionally separated by colons
+func ParseFingerprint(f string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(f, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("%q is not SHA-256 fingerprint in hex", f)
+	}
+	return b, nil
+}
+
+func validateNotNegative(key string, d time.Duration, v *ValidationError) {
+	if d < 0 {
+		v.add("%s must not be negative", key)
+	}
+}
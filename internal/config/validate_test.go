@@ -0,0 +1,166 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// validConfig returns config which passes validation, tests change single values of it
+func validConfig() Config {
+	return Config{
+		Lists: map[string]List{"test": {
+			Token:          "secret",
+			URL:            "http://provider.test/list.m3u",
+			MaxConnections: 1,
+		}},
+		App: App{EncryptionKey: "key", URL: "http://proxy.test", LogLevel: "info"},
+		Server: Server{
+			Port:              8080,
+			HLSSessionTimeout: 10 * time.Second,
+			Repackage:         Repackage{SegmentDuration: 4 * time.Second, PlaylistSize: 6, IdleTimeout: time.Minute},
+			Probe:             Probe{Interval: time.Hour, Timeout: 10 * time.Second, Slots: 1, History: 5},
+			CircuitBreaker:    CircuitBreaker{Failures: 5, OpenTimeout: 10 * time.Second, MaxOpenTimeout: 5 * time.Minute},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			change: func(c *Config) {},
+		},
+		{
+			name: "default encryption key",
+			change: func(c *Config) {
+				c.App.EncryptionKey = DefaultEncryptionKey
+			},
+			want: []string{`app.encryptionKey has default value "some_key", set your own key (APP_ENCRYPTIONKEY) or set app.allowDefaultEncryptionKey to true`},
+		},
+		{
+			name: "allowed default encryption key",
+			change: func(c *Config) {
+				c.App.EncryptionKey = DefaultEncryptionKey
+				c.App.AllowDefaultEncryptionKey = true
+			},
+		},
+		{
+			name: "app url",
+			change: func(c *Config) {
+				c.App.URL = "ftp://proxy.test/"
+			},
+			want: []string{`app.url "ftp://proxy.test/" must start with http:// or https://`, `app.url "ftp://proxy.test/" must not contain path, trailing slash, query or fragment`},
+		},
+		{
+			name: "server values",
+			change: func(c *Config) {
+				c.Server.Port = 0
+				c.Server.Listen = "localhost"
+				c.Server.WriteTimeout = -time.Second
+				c.Server.SegmentCache = SegmentCache{Size: 10, MaxSegmentSize: 20}
+			},
+			want: []string{
+				"server.port 0 is out of range 1-65535",
+				`server.listen "localhost" is not valid host:port address: address localhost: missing port in address`,
+				"server.writeTimeout must not be negative",
+				"server.segmentCache.maxSegmentSize must be greater than 0 and not greater than server.segmentCache.size",
+			},
+		},
+		{
+			name: "circuit breaker",
+			change: func(c *Config) {
+				c.Server.CircuitBreaker.MaxOpenTimeout = time.Second
+			},
+			want: []string{"server.circuitBreaker.maxOpenTimeout must be at least server.circuitBreaker.openTimeout"},
+		},
+		{
+			name: "disabled circuit breaker",
+			change: func(c *Config) {
+				c.Server.CircuitBreaker = CircuitBreaker{}
+			},
+		},
+		{
+			name: "tls",
+			change: func(c *Config) {
+				c.Server.TLS = TLS{Enabled: true, Port: 8443, CertFile: "cert.pem", RedirectHTTP: true}
+			},
+			want: []string{
+				"server.tls.certFile and server.tls.keyFile must be set together",
+				`app.url "http://proxy.test" must use https:// when server.tls.redirectHTTP is true`,
+			},
+		},
+		{
+			name: "list values",
+			change: func(c *Config) {
+				c.Lists["test"] = List{
+					URL:             "/list.m3u",
+					EPG:             "epg.xml",
+					CatchupTimezone: "Mars/Olympus",
+					Proxy:           "ftp://proxy.test",
+				}
+			},
+			want: []string{
+				"list test: token is empty",
+				"list test: maxConnections is 0, it must be at least 1",
+				`list test: url "/list.m3u" must be absolute http:// or https:// url`,
+				`list test: epg "epg.xml" must be absolute http:// or https:// url`,
+				`list test: catchupTimezone "Mars/Olympus" is not valid time zone`,
+				"list test: proxy must be http://, https:// or socks5:// url",
+			},
+		},
+		{
+			name: "list headers and cookies",
+			change: func(c *Config) {
+				l := c.Lists["test"]
+				l.Headers = UpstreamHeaders{Passthrough: []string{"Host"}, Set: map[string]string{"Connection": "close"}}
+				l.Cookies = Cookies{LoginURL: "http://provider.test/login", Values: []string{"session"}}
+				c.Lists["test"] = l
+			},
+			want: []string{
+				"list test: headers.passthrough can't contain Host header",
+				"list test: headers.set can't contain Connection header",
+				`list test: cookie "session" must be written as name=value`,
+				"list test: cookies.loginURL requires cookies.jar to be true",
+			},
+		},
+		{
+			name: "variants",
+			change: func(c *Config) {
+				l := c.Lists["test"]
+				l.Variants = Variants{
+					VariantFilter: VariantFilter{Single: "nearest"},
+					Profiles:      []VariantProfile{{Clients: []string{"10.0.0.0/33"}, VariantFilter: VariantFilter{MaxResolution: "720p"}}},
+				}
+				c.Lists["test"] = l
+			},
+			want: []string{
+				"list test: variants.single nearest needs maxBandwidth or maxResolution",
+				`list test: variants.profiles[0].clients: "10.0.0.0/33" is not ip or CIDR network`,
+				`list test: variants.profiles[0].maxResolution: resolution "720p" must be written as WIDTHxHEIGHT`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.change(&c)
+			err := Validate(c)
+			var got []string
+			var v *ValidationError
+			if errors.As(err, &v) {
+				got = v.Problems
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
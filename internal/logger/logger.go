@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level of log message
+type Level int32
+
+// Log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+var levelPrefixes = map[Level]string{
+	LevelDebug: "DEBUG ",
+	LevelInfo:  "",
+	LevelWarn:  "WARN ",
+	LevelError: "ERROR ",
+}
+
+var level = int32(LevelInfo)
+
+// ParseLevel returns level by its name: debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	l, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return LevelInfo, errors.New("Unknown log level " + name + ", use one of: debug, info, warn, error")
+	}
+	return l, nil
+}
+
+// SetLevel sets minimal level of logged messages by its name
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&level, int32(l))
+	return nil
+}
+
+// Debug logs message useful only for debugging
+func Debug(v ...interface{}) {
+	output(LevelDebug, fmt.Sprintln(v...))
+}
+
+// Info logs regular message
+func Info(v ...interface{}) {
+	output(LevelInfo, fmt.Sprintln(v...))
+}
+
+// Warn logs message about problem that doesnt break request
+func Warn(v ...interface{}) {
+	output(LevelWarn, fmt.Sprintln(v...))
+}
+
+// Error logs message about failure
+func Error(v ...interface{}) {
+	output(LevelError, fmt.Sprintln(v...))
+}
+
+// Debugf logs formatted debug message
+func Debugf(format string, v ...interface{}) {
+	output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Infof logs formatted regular message
+func Infof(format string, v ...interface{}) {
+	output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs formatted warning message
+func Warnf(format string, v ...interface{}) {
+	output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs formatted error message
+func Errorf(format string, v ...interface{}) {
+	output(LevelError, fmt.Sprintf(format, v...))
+}
+
+func output(l Level, msg string) {
+	if int32(l) < atomic.LoadInt32(&level) {
+		return
+	}
+	log.Output(3, levelPrefixes[l]+msg)
+}
@@ -0,0 +1,113 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+)
+
+const nullPID = 0x1FFF
+
+// Joiner writes independent segments as one continuous transport stream.
+// Continuity counters are renumbered across segment boundaries and after discontinuity
+// the next PCR is flagged with discontinuity indicator, so players reset their clock instead of stalling.
+type Joiner struct {
+	w         io.Writer
+	partial   []byte
+	counters  map[uint16]byte
+	markPCR   bool
+	packetBuf []byte
+}
+
+// NewJoiner returns joiner writing stream to w
+func NewJoiner(w io.Writer) *Joiner {
+	return &Joiner{w: w, counters: make(map[uint16]byte)}
+}
+
+// StartSegment is called before data of every segment, discontinuity marks time base change of the new segment
+func (j *Joiner) StartSegment(discontinuity bool) {
+	// rest of broken packet of previous segment can't be completed by the new one
+	j.partial = j.partial[:0]
+	if discontinuity {
+		j.markPCR = true
+	}
+}
+
+// Write writes segment data, it doesn't have to be aligned to packets
+func (j *Joiner) Write(p []byte) (int, error) {
+	n := len(p)
+	out := j.packetBuf[:0]
+	if len(j.partial) > 0 {
+		need := PacketSize - len(j.partial)
+		if len(p) < need {
+			j.partial = append(j.partial, p...)
+			return n, nil
+		}
+		j.partial = append(j.partial, p[:need]...)
+		p = p[need:]
+		out = j.packet(out, j.partial)
+		j.partial = j.partial[:0]
+	}
+
+	for len(p) > 0 {
+		if p[0] != SyncByte {
+			i := bytes.IndexByte(p, SyncByte)
+			if i < 0 {
+				break
+			}
+			p = p[i:]
+			continue
+		}
+		if len(p) < PacketSize {
+			j.partial = append(j.partial, p...)
+			break
+		}
+		out = j.packet(out, p[:PacketSize])
+		p = p[PacketSize:]
+	}
+
+	j.packetBuf = out[:0]
+	if len(out) == 0 {
+		return n, nil
+	}
+	if _, err := j.w.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// packet appends packet with fixed continuity counter and discontinuity indicator to out
+func (j *Joiner) packet(out, p []byte) []byte {
+	start := len(out)
+	out = append(out, p...)
+	pkt := out[start:]
+
+	pid := packetPID(pkt)
+	if pid == nullPID {
+		return out
+	}
+
+	hasPayload := pkt[3]&0x10 != 0
+	cc, known := j.counters[pid]
+	switch {
+	case !known:
+		cc = pkt[3] & 0x0F
+	case hasPayload:
+		cc = (cc + 1) & 0x0F
+	}
+	j.counters[pid] = cc
+	pkt[3] = pkt[3]&0xF0 | cc
+
+	if j.markPCR && hasPCR(pkt) {
+		pkt[5] |= 0x80
+		j.markPCR = false
+	}
+	return out
+}
+
+// hasPCR reports if adaptation field of packet carries program clock reference
+func hasPCR(p []byte) bool {
+	if p[3]&0x20 == 0 || p[4] == 0 {
+		return false
+	}
+	return p[5]&0x10 != 0
+}
@@ -0,0 +1,136 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// join writes segments to joiner in chunks of chunkSize, discontinuity of segment is taken from discontinuities
+func join(t *testing.T, segments []Segment, discontinuities []bool, chunkSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	j := NewJoiner(&out)
+	for i, seg := range segments {
+		j.StartSegment(discontinuities[i])
+		data := seg.Data
+		for len(data) > 0 {
+			n := chunkSize
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := j.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+	}
+	return out.Bytes()
+}
+
+// checkContinuity checks continuity counters of every PID increase with each packet carrying payload
+func checkContinuity(t *testing.T, data []byte) {
+	t.Helper()
+	counters := map[uint16]byte{}
+	for i := 0; i+PacketSize <= len(data); i += PacketSize {
+		p := data[i : i+PacketSize]
+		pid := packetPID(p)
+		cc := p[3] & 0x0F
+		last, known := counters[pid]
+		want := last
+		if p[3]&0x10 != 0 {
+			want = (last + 1) & 0x0F
+		}
+		if known && cc != want {
+			t.Fatalf("packet %d of PID %#x: continuity counter %d, want %d", i/PacketSize, pid, cc, want)
+		}
+		counters[pid] = cc
+	}
+}
+
+// pcrDiscontinuities returns indexes of segments whose PCR packets have discontinuity indicator set
+func pcrDiscontinuities(t *testing.T, data []byte, segments []Segment) []int {
+	t.Helper()
+	marked := []int{}
+	offset := 0
+	for i, seg := range segments {
+		for j := offset; j < offset+len(seg.Data); j += PacketSize {
+			p := data[j : j+PacketSize]
+			if hasPCR(p) && p[5]&0x80 != 0 {
+				marked = append(marked, i)
+				if j != offset+firstPCR(seg.Data) {
+					t.Errorf("segment %d: discontinuity indicator isn't on its first PCR", i)
+				}
+			}
+		}
+		offset += len(seg.Data)
+	}
+	return marked
+}
+
+func firstPCR(data []byte) int {
+	for i := 0; i+PacketSize <= len(data); i += PacketSize {
+		if hasPCR(data[i : i+PacketSize]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestJoiner(t *testing.T) {
+	segments := segment(t, readFixture(t, "keyframes.ts"), 2*time.Second, 1<<20)
+	if len(segments) != 4 {
+		t.Fatalf("got %d segments, want 4", len(segments))
+	}
+
+	tests := []struct {
+		name            string
+		discontinuities []bool
+		chunkSize       int
+		marked          []int
+	}{
+		{name: "continuous", discontinuities: []bool{false, false, false, false}, chunkSize: 1 << 20, marked: []int{}},
+		{name: "discontinuity", discontinuities: []bool{false, true, false, true}, chunkSize: 1 << 20, marked: []int{1, 3}},
+		{name: "unaligned writes", discontinuities: []bool{true, false, true, false}, chunkSize: 1000, marked: []int{0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := join(t, segments, tt.discontinuities, tt.chunkSize)
+			size := 0
+			for _, seg := range segments {
+				size += len(seg.Data)
+			}
+			if len(out) != size {
+				t.Fatalf("got %d bytes, want %d", len(out), size)
+			}
+			checkContinuity(t, out)
+			marked := pcrDiscontinuities(t, out, segments)
+			if len(marked) != len(tt.marked) {
+				t.Fatalf("got discontinuity indicator in segments %v, want %v", marked, tt.marked)
+			}
+			for i := range marked {
+				if marked[i] != tt.marked[i] {
+					t.Errorf("got discontinuity indicator in segments %v, want %v", marked, tt.marked)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinerDropsBrokenPacket(t *testing.T) {
+	segments := segment(t, readFixture(t, "keyframes.ts"), 2*time.Second, 1<<20)
+	var out bytes.Buffer
+	j := NewJoiner(&out)
+	j.StartSegment(false)
+	// first segment is cut in the middle of packet, its rest is dropped when next segment starts
+	broken := segments[0].Data[:len(segments[0].Data)-PacketSize/2]
+	j.Write(broken)
+	j.StartSegment(false)
+	j.Write(segments[1].Data)
+
+	want := len(broken)/PacketSize*PacketSize + len(segments[1].Data)
+	if out.Len() != want {
+		t.Fatalf("got %d bytes, want %d", out.Len(), want)
+	}
+	checkContinuity(t, out.Bytes())
+}
@@ -0,0 +1,152 @@
+package mpegts
+
+import "time"
+
+// PacketSize is size of transport stream packet
+const PacketSize = 188
+
+// SyncByte starts every transport stream packet
+const SyncByte = 0x47
+
+const (
+	patPID        = 0x0000
+	patTableID    = 0x00
+	pmtTableID    = 0x02
+	clockRate     = 90000
+	timestampWrap = 1 << 33
+)
+
+// Stream types of program map table
+const (
+	StreamTypeMPEG1Video = 0x01
+	StreamTypeMPEG2Video = 0x02
+	StreamTypeMPEG4Video = 0x10
+	StreamTypeH264       = 0x1B
+	StreamTypeHEVC       = 0x24
+)
+
+// ElementaryStream is stream listed in program map table
+type ElementaryStream struct {
+	PID  uint16
+	Type byte
+}
+
+// IsVideo reports if stream type is video codec
+func (es ElementaryStream) IsVideo() bool {
+	switch es.Type {
+	case StreamTypeMPEG1Video, StreamTypeMPEG2Video, StreamTypeMPEG4Video, StreamTypeH264, StreamTypeHEVC:
+		return true
+	}
+	return false
+}
+
+func packetPID(p []byte) uint16 {
+	return uint16(p[1]&0x1F)<<8 | uint16(p[2])
+}
+
+func payloadUnitStart(p []byte) bool {
+	return p[1]&0x40 != 0
+}
+
+// payload returns packet payload, nil when packet has only adaptation field
+func payload(p []byte) []byte {
+	switch (p[3] >> 4) & 0x3 {
+	case 1:
+		return p[4:]
+	case 3:
+		start := 5 + int(p[4])
+		if start >= PacketSize {
+			return nil
+		}
+		return p[start:]
+	}
+	return nil
+}
+
+// randomAccess reports random access indicator of adaptation field
+func randomAccess(p []byte) bool {
+	if (p[3]>>4)&0x2 == 0 || p[4] == 0 {
+		return false
+	}
+	return p[5]&0x40 != 0
+}
+
+// pesTimestamp returns decoding timestamp of PES packet starting in payload, or presentation one when there is no DTS
+func pesTimestamp(pl []byte) (int64, bool) {
+	if len(pl) < 14 || pl[0] != 0 || pl[1] != 0 || pl[2] != 1 {
+		return 0, false
+	}
+	flags := pl[7] >> 6
+	switch {
+	case flags == 3 && len(pl) >= 19:
+		return readTimestamp(pl[14:19]), true
+	case flags&0x2 != 0:
+		return readTimestamp(pl[9:14]), true
+	}
+	return 0, false
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// pesData returns elementary stream data of PES packet starting in payload
+func pesData(pl []byte) []byte {
+	if len(pl) < 9 {
+		return nil
+	}
+	start := 9 + int(pl[8])
+	if start > len(pl) {
+		return nil
+	}
+	return pl[start:]
+}
+
+// timestampDelta returns difference of 33 bit timestamps handling wrap around
+func timestampDelta(from, to int64) int64 {
+	d := (to - from) % timestampWrap
+	if d < 0 {
+		d += timestampWrap
+	}
+	if d > timestampWrap/2 {
+		d -= timestampWrap
+	}
+	return d
+}
+
+func timestampDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockRate
+}
+
+// isKeyframe looks for start codes of random access pictures or sequence headers in elementary stream data
+func isKeyframe(streamType byte, data []byte) bool {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		code := data[i+3]
+		switch streamType {
+		case StreamTypeH264:
+			// IDR slice or sequence parameter set
+			if t := code & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+		case StreamTypeHEVC:
+			// IRAP picture or parameter sets
+			if t := (code >> 1) & 0x3F; t >= 16 && t <= 21 || t == 32 || t == 33 {
+				return true
+			}
+		case StreamTypeMPEG1Video, StreamTypeMPEG2Video:
+			// sequence header
+			if code == 0xB3 {
+				return true
+			}
+		case StreamTypeMPEG4Video:
+			// visual object sequence
+			if code == 0xB0 {
+				return true
+			}
+		}
+	}
+	return false
+}
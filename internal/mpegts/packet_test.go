@@ -0,0 +1,90 @@
+package mpegts
+
+import "testing"
+
+// pesHeader returns start of PES with timestamps of flags, 2 is PTS only and 3 is PTS and DTS
+func pesHeader(flags byte, pts, dts int64) []byte {
+	h := []byte{0, 0, 1, 0xE0, 0, 0, 0x80, flags << 6, 0}
+	if flags&0x2 != 0 {
+		h = append(h, encodeTimestamp(flags, pts)...)
+	}
+	if flags == 3 {
+		h = append(h, encodeTimestamp(1, dts)...)
+	}
+	h[8] = byte(len(h) - 9)
+	return append(h, 0, 0, 0, 1, 0x65)
+}
+
+func encodeTimestamp(marker byte, v int64) []byte {
+	return []byte{marker<<4 | byte(v>>30&0x07)<<1 | 1, byte(v >> 22), byte(v>>15&0x7F)<<1 | 1, byte(v >> 7), byte(v&0x7F)<<1 | 1}
+}
+
+func TestPESTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		pl   []byte
+		want int64
+		ok   bool
+	}{
+		{name: "presentation timestamp", pl: pesHeader(2, 123456, 0), want: 123456, ok: true},
+		{name: "decoding timestamp is preferred", pl: pesHeader(3, 7200, 3600), want: 3600, ok: true},
+		{name: "max timestamp", pl: pesHeader(2, timestampWrap-1, 0), want: timestampWrap - 1, ok: true},
+		{name: "no timestamps", pl: pesHeader(0, 0, 0)},
+		{name: "missing start code", pl: append([]byte{0, 0, 2}, pesHeader(2, 1, 0)[3:]...)},
+		{name: "truncated header", pl: pesHeader(2, 1, 0)[:10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pesTimestamp(tt.pl)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %d %v, want %d %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTimestampDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int64
+		want     int64
+	}{
+		{name: "forward", from: 1000, to: 4600, want: 3600},
+		{name: "backward", from: 4600, to: 1000, want: -3600},
+		{name: "wrap around", from: timestampWrap - 1800, to: 1800, want: 3600},
+		{name: "backward over wrap", from: 1800, to: timestampWrap - 1800, want: -3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := timestampDelta(tt.from, tt.to); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name       string
+		streamType byte
+		data       []byte
+		want       bool
+	}{
+		{name: "h264 idr", streamType: StreamTypeH264, data: []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 1, 0x65, 0x88}, want: true},
+		{name: "h264 sps", streamType: StreamTypeH264, data: []byte{0, 0, 1, 0x67, 0x42}, want: true},
+		{name: "h264 non idr slice", streamType: StreamTypeH264, data: []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 1, 0x41, 0x9A}},
+		{name: "hevc idr", streamType: StreamTypeHEVC, data: []byte{0, 0, 1, 0x26, 0x01, 0xAF}, want: true},
+		{name: "hevc vps", streamType: StreamTypeHEVC, data: []byte{0, 0, 1, 0x40, 0x01, 0x0C}, want: true},
+		{name: "hevc trailing picture", streamType: StreamTypeHEVC, data: []byte{0, 0, 1, 0x02, 0x01, 0xD0}},
+		{name: "mpeg2 sequence header", streamType: StreamTypeMPEG2Video, data: []byte{0, 0, 1, 0xB3, 0x14}, want: true},
+		{name: "mpeg2 picture", streamType: StreamTypeMPEG2Video, data: []byte{0, 0, 1, 0x00, 0x14}},
+		{name: "start code cut off", streamType: StreamTypeH264, data: []byte{0, 0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isKeyframe(tt.streamType, tt.data); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package mpegts
+
+// psiSection returns section of table starting in packet payload, sections spanning more packets are not supported
+func psiSection(pl []byte, tableID byte) ([]byte, bool) {
+	if len(pl) < 1 {
+		return nil, false
+	}
+	start := 1 + int(pl[0])
+	if start+3 > len(pl) {
+		return nil, false
+	}
+	s := pl[start:]
+	if s[0] != tableID {
+		return nil, false
+	}
+	length := int(s[1]&0x0F)<<8 | int(s[2])
+	if 3+length > len(s) || length < 9 {
+		return nil, false
+	}
+	return s[:3+length], true
+}
+
+// parsePAT returns PID of program map table of first program
+func parsePAT(pl []byte) (uint16, bool) {
+	s, ok := psiSection(pl, patTableID)
+	if !ok {
+		return 0, false
+	}
+	// programs follow 8 bytes of header and are followed by 4 bytes of CRC
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		if program == 0 {
+			// network information table
+			continue
+		}
+		return uint16(s[i+2]&0x1F)<<8 | uint16(s[i+3]), true
+	}
+	return 0, false
+}
+
+// parsePMT returns elementary streams and version of program map table
+func parsePMT(pl []byte) ([]ElementaryStream, byte, bool) {
+	s, ok := psiSection(pl, pmtTableID)
+	if !ok || len(s) < 16 {
+		return nil, 0, false
+	}
+	version := (s[5] >> 1) & 0x1F
+	infoLength := int(s[10]&0x0F)<<8 | int(s[11])
+
+	streams := []ElementaryStream{}
+	end := len(s) - 4
+	for i := 12 + infoLength; i+5 <= end; {
+		streams = append(streams, ElementaryStream{
+			Type: s[i],
+			PID:  uint16(s[i+1]&0x1F)<<8 | uint16(s[i+2]),
+		})
+		i += 5 + (int(s[i+3]&0x0F)<<8 | int(s[i+4]))
+	}
+	return streams, version, len(streams) > 0
+}
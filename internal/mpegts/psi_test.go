@@ -0,0 +1,94 @@
+package mpegts
+
+import (
+	"reflect"
+	"testing"
+)
+
+// findPacket returns nth packet of PID starting payload unit in stream
+func findPacket(t *testing.T, data []byte, pid uint16, nth int) []byte {
+	t.Helper()
+	for i := 0; i+PacketSize <= len(data); i += PacketSize {
+		p := data[i : i+PacketSize]
+		if packetPID(p) != pid || !payloadUnitStart(p) {
+			continue
+		}
+		if nth == 0 {
+			return p
+		}
+		nth--
+	}
+	t.Fatalf("packet of PID %#x not found", pid)
+	return nil
+}
+
+func TestParsePAT(t *testing.T) {
+	pat := findPacket(t, readFixture(t, "keyframes.ts"), patPID, 0)
+	pmt := findPacket(t, readFixture(t, "keyframes.ts"), 0x1000, 0)
+	truncated := append([]byte{}, pat...)
+	// section length pointing behind packet
+	truncated[6] |= 0x0F
+
+	tests := []struct {
+		name    string
+		payload []byte
+		pid     uint16
+		ok      bool
+	}{
+		{name: "program association table", payload: payload(pat), pid: 0x1000, ok: true},
+		{name: "other table", payload: payload(pmt)},
+		{name: "truncated section", payload: payload(truncated)},
+		{name: "pointer behind payload", payload: []byte{0xFF, 0x00, 0xB0}},
+		{name: "empty payload", payload: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, ok := parsePAT(tt.payload)
+			if pid != tt.pid || ok != tt.ok {
+				t.Errorf("got %#x %v, want %#x %v", pid, ok, tt.pid, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParsePMT(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		nth     int
+		streams []ElementaryStream
+		version byte
+	}{
+		{
+			name:    "video and audio",
+			fixture: "keyframes.ts",
+			streams: []ElementaryStream{{PID: 0x100, Type: StreamTypeH264}, {PID: 0x101, Type: 0x0F}},
+		},
+		{
+			name:    "audio only",
+			fixture: "audio.ts",
+			streams: []ElementaryStream{{PID: 0x101, Type: 0x0F}},
+		},
+		{
+			name:    "new version",
+			fixture: "pmtchange.ts",
+			nth:     11,
+			streams: []ElementaryStream{{PID: 0x100, Type: StreamTypeH264}, {PID: 0x101, Type: 0x0F}},
+			version: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := findPacket(t, readFixture(t, tt.fixture), 0x1000, tt.nth)
+			streams, version, ok := parsePMT(payload(p))
+			if !ok || version != tt.version || !reflect.DeepEqual(streams, tt.streams) {
+				t.Errorf("got %v version %d %v, want %v version %d", streams, version, ok, tt.streams, tt.version)
+			}
+		})
+	}
+
+	pat := findPacket(t, readFixture(t, "keyframes.ts"), patPID, 0)
+	if _, _, ok := parsePMT(payload(pat)); ok {
+		t.Errorf("PAT parsed as PMT")
+	}
+}
@@ -0,0 +1,218 @@
+package mpegts
+
+import (
+	"bytes"
+	"time"
+)
+
+// maxTimestampGap is the biggest forward jump of timestamps still considered continuous stream,
+// decoding timestamps never go back so any backward jump is discontinuity
+const maxTimestampGap = 10 * clockRate
+
+// maxDurationFactor limits segment duration when stream has no recognizable keyframes
+const maxDurationFactor = 3
+
+// maxOvershoot is how much segment can exceed max duration, its duration rounded to whole seconds
+// still fits target duration of playlist rounded up from max duration
+const maxOvershoot = clockRate * 4 / 10
+
+// MaxDuration returns the longest segment cut for target duration, it is fixed target duration of media playlists
+func MaxDuration(target time.Duration) time.Duration {
+	return maxDurationFactor * target
+}
+
+// Segment is part of stream starting with PAT, PMT and keyframe, so it can be decoded on its own
+type Segment struct {
+	Data          []byte
+	Duration      time.Duration
+	Discontinuity bool
+}
+
+// Segmenter splits MPEG-TS stream into segments of about target duration.
+// Segments are cut on keyframes of first video stream, audio only streams are cut on any PES packet.
+// Timestamps of the main stream are used for durations, their jumps start discontinuous segment.
+type Segmenter struct {
+	target    time.Duration
+	onSegment func(Segment)
+
+	partial []byte
+
+	pmtPID     uint16
+	hasPAT     bool
+	pat, pmt   []byte
+	pmtVersion int
+	main       ElementaryStream
+	hasMain    bool
+
+	started          bool
+	current          []byte
+	startTime        int64
+	lastTime         int64
+	lastSize         int
+	discontinuity    bool
+	curDiscontinuity bool
+}
+
+// NewSegmenter returns segmenter calling onSegment with every finished segment
+func NewSegmenter(target time.Duration, onSegment func(Segment)) *Segmenter {
+	return &Segmenter{target: target, onSegment: onSegment, pmtVersion: -1}
+}
+
+// Write feeds stream data, it doesn't have to be aligned to packets
+func (s *Segmenter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(s.partial) > 0 {
+		need := PacketSize - len(s.partial)
+		if len(p) < need {
+			s.partial = append(s.partial, p...)
+			return n, nil
+		}
+		s.partial = append(s.partial, p[:need]...)
+		p = p[need:]
+		s.packet(s.partial)
+		s.partial = s.partial[:0]
+	}
+
+	for len(p) > 0 {
+		if p[0] != SyncByte {
+			// lost sync, continue from next sync byte
+			i := bytes.IndexByte(p, SyncByte)
+			if i < 0 {
+				break
+			}
+			p = p[i:]
+			continue
+		}
+		if len(p) < PacketSize {
+			s.partial = append(s.partial, p...)
+			break
+		}
+		s.packet(p[:PacketSize])
+		p = p[PacketSize:]
+	}
+	return n, nil
+}
+
+// Discontinue finishes current segment and marks next one discontinuous, it is used when source stream is reopened
+func (s *Segmenter) Discontinue() {
+	s.partial = s.partial[:0]
+	if s.started {
+		s.finish(timestampDelta(s.startTime, s.lastTime))
+	}
+	s.started = false
+	s.discontinuity = true
+}
+
+func (s *Segmenter) packet(p []byte) {
+	pid := packetPID(p)
+	switch {
+	case pid == patPID:
+		if payloadUnitStart(p) {
+			if pmtPID, ok := parsePAT(payload(p)); ok {
+				s.pmtPID = pmtPID
+				s.hasPAT = true
+				s.pat = append(s.pat[:0], p...)
+			}
+		}
+	case s.hasPAT && pid == s.pmtPID:
+		if payloadUnitStart(p) {
+			s.programMap(p)
+		}
+	case s.hasMain && pid == s.main.PID && payloadUnitStart(p):
+		if t, ok := pesTimestamp(payload(p)); ok {
+			s.mainPES(p, t)
+		}
+	}
+
+	if s.started {
+		s.current = append(s.current, p...)
+	}
+}
+
+func (s *Segmenter) programMap(p []byte) {
+	streams, version, ok := parsePMT(payload(p))
+	if !ok {
+		return
+	}
+	s.pmt = append(s.pmt[:0], p...)
+	if int(version) == s.pmtVersion {
+		return
+	}
+	if s.pmtVersion >= 0 {
+		// program changed, new segment has to start with new tables
+		s.Discontinue()
+	}
+	s.pmtVersion = int(version)
+
+	s.main = streams[0]
+	for _, es := range streams {
+		if es.IsVideo() {
+			s.main = es
+			break
+		}
+	}
+	s.hasMain = true
+}
+
+func (s *Segmenter) mainPES(p []byte, t int64) {
+	if s.started {
+		if gap := timestampDelta(s.lastTime, t); gap > maxTimestampGap || gap < 0 {
+			s.Discontinue()
+		}
+	}
+
+	keyframe := !s.main.IsVideo() || randomAccess(p) || isKeyframe(s.main.Type, pesData(payload(p)))
+	if !s.started {
+		if keyframe {
+			s.begin(t)
+		}
+		return
+	}
+
+	elapsed := timestampDelta(s.startTime, t)
+	target := int64(s.target / time.Millisecond * clockRate / 1000)
+	if elapsed >= maxDurationFactor*target+maxOvershoot {
+		// gap in timestamps would make segment longer than max duration, it ends at previous timestamp
+		s.Discontinue()
+		s.begin(t)
+		return
+	}
+	if keyframe && elapsed >= target || elapsed >= maxDurationFactor*target {
+		s.finish(elapsed)
+		s.begin(t)
+		return
+	}
+	if timestampDelta(s.lastTime, t) > 0 {
+		s.lastTime = t
+	}
+}
+
+// begin starts segment with current tables, packet which started it is appended by caller
+func (s *Segmenter) begin(t int64) {
+	s.current = make([]byte, 0, s.lastSize+PacketSize*16)
+	s.current = append(s.current, s.pat...)
+	s.current = append(s.current, s.pmt...)
+	s.startTime = t
+	s.lastTime = t
+	s.started = true
+	s.curDiscontinuity = s.discontinuity
+	s.discontinuity = false
+}
+
+func (s *Segmenter) finish(elapsed int64) {
+	if elapsed <= 0 {
+		// nothing playable, its discontinuity moves to next segment
+		s.discontinuity = s.discontinuity || s.curDiscontinuity
+		s.current = nil
+		s.started = false
+		return
+	}
+	s.lastSize = len(s.current)
+	s.onSegment(Segment{
+		Data:          s.current,
+		Duration:      timestampDuration(elapsed),
+		Discontinuity: s.curDiscontinuity,
+	})
+	s.current = nil
+	s.started = false
+}
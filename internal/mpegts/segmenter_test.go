@@ -0,0 +1,224 @@
+package mpegts
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readFixture returns transport stream of testdata, fixtures are made by testdata/generate.py
+func readFixture(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// segment writes stream to segmenter in chunks of chunkSize and returns finished segments
+func segment(t testing.TB, data []byte, target time.Duration, chunkSize int) []Segment {
+	t.Helper()
+	var segments []Segment
+	s := NewSegmenter(target, func(seg Segment) {
+		segments = append(segments, seg)
+	})
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := s.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	return segments
+}
+
+func TestSegmenter(t *testing.T) {
+	type want struct {
+		duration      time.Duration
+		discontinuity bool
+	}
+	tests := []struct {
+		name     string
+		fixture  string
+		target   time.Duration
+		mainPID  uint16
+		keyframe bool
+		want     []want
+	}{
+		{
+			name:     "cut on keyframes",
+			fixture:  "keyframes.ts",
+			target:   2 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{2 * time.Second, false}, {2 * time.Second, false}, {2 * time.Second, false}, {2 * time.Second, false}},
+		},
+		{
+			name:     "wait for keyframe after target",
+			fixture:  "keyframes.ts",
+			target:   3 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{4 * time.Second, false}, {4 * time.Second, false}},
+		},
+		{
+			name:    "max duration without keyframes",
+			fixture: "nokeyframes.ts",
+			target:  time.Second,
+			mainPID: 0x100,
+			want:    []want{{3 * time.Second, false}, {3 * time.Second, false}},
+		},
+		{
+			name:     "timestamp jump",
+			fixture:  "gap.ts",
+			target:   2 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{2 * time.Second, false}, {1960 * time.Millisecond, false}, {2 * time.Second, true}, {2 * time.Second, false}},
+		},
+		{
+			name:     "timestamps going back",
+			fixture:  "restart.ts",
+			target:   2 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{2 * time.Second, false}, {1960 * time.Millisecond, false}, {2 * time.Second, true}, {2 * time.Second, false}},
+		},
+		{
+			name:     "gap longer than max duration",
+			fixture:  "stall.ts",
+			target:   2 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{2 * time.Second, false}, {360 * time.Millisecond, false}, {3600 * time.Millisecond, true}, {2 * time.Second, false}},
+		},
+		{
+			name:     "timestamp wrap around",
+			fixture:  "wrap.ts",
+			target:   2 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{2 * time.Second, false}, {2 * time.Second, false}, {2 * time.Second, false}, {2 * time.Second, false}},
+		},
+		{
+			name:     "program change",
+			fixture:  "pmtchange.ts",
+			target:   2 * time.Second,
+			mainPID:  0x100,
+			keyframe: true,
+			want:     []want{{2 * time.Second, false}, {2 * time.Second, false}, {360 * time.Millisecond, false}, {2 * time.Second, true}},
+		},
+		{
+			name:    "audio only",
+			fixture: "audio.ts",
+			target:  time.Second,
+			mainPID: 0x101,
+			want:    []want{{time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readFixture(t, tt.fixture)
+			segments := segment(t, data, tt.target, len(data))
+			if len(segments) != len(tt.want) {
+				t.Fatalf("got %d segments, want %d", len(segments), len(tt.want))
+			}
+			for i, seg := range segments {
+				if seg.Duration != tt.want[i].duration || seg.Discontinuity != tt.want[i].discontinuity {
+					t.Errorf("segment %d: got %v discontinuity %v, want %v discontinuity %v",
+						i, seg.Duration, seg.Discontinuity, tt.want[i].duration, tt.want[i].discontinuity)
+				}
+				if seg.Duration > MaxDuration(tt.target) {
+					t.Errorf("segment %d: %v is longer than max duration %v", i, seg.Duration, MaxDuration(tt.target))
+				}
+				checkSegmentStart(t, i, seg.Data, tt.mainPID, tt.keyframe)
+			}
+		})
+	}
+}
+
+// checkSegmentStart checks segment is made of whole packets and starts with PAT, PMT and PES of main stream
+func checkSegmentStart(t *testing.T, i int, data []byte, mainPID uint16, keyframe bool) {
+	t.Helper()
+	if len(data)%PacketSize != 0 || len(data) < 3*PacketSize {
+		t.Errorf("segment %d: size %d is not made of packets", i, len(data))
+		return
+	}
+	if pid := packetPID(data); pid != patPID {
+		t.Errorf("segment %d: first packet has PID %#x, want PAT", i, pid)
+	}
+	if _, _, ok := parsePMT(payload(data[PacketSize:])); !ok {
+		t.Errorf("segment %d: second packet is not PMT", i)
+	}
+	p := data[2*PacketSize : 3*PacketSize]
+	if pid := packetPID(p); pid != mainPID || !payloadUnitStart(p) {
+		t.Errorf("segment %d: third packet has PID %#x, want start of PES of %#x", i, pid, mainPID)
+	}
+	if keyframe && !randomAccess(p) {
+		t.Errorf("segment %d: doesn't start with keyframe", i)
+	}
+}
+
+func TestSegmenterUnalignedWrites(t *testing.T) {
+	data := readFixture(t, "keyframes.ts")
+	want := segment(t, data, 2*time.Second, len(data))
+
+	// garbage before stream is skipped until sync byte
+	broken := append([]byte{0x00, 0x12, 0x34}, data...)
+	tests := []struct {
+		name      string
+		data      []byte
+		chunkSize int
+	}{
+		{name: "single bytes", data: data, chunkSize: 1},
+		{name: "chunks across packets", data: data, chunkSize: 1000},
+		{name: "garbage before sync", data: broken, chunkSize: 7 * PacketSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := segment(t, tt.data, 2*time.Second, tt.chunkSize)
+			if len(got) != len(want) {
+				t.Fatalf("got %d segments, want %d", len(got), len(want))
+			}
+			for i := range got {
+				if got[i].Duration != want[i].Duration || !bytes.Equal(got[i].Data, want[i].Data) {
+					t.Errorf("segment %d differs from aligned write", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmenterDiscontinue(t *testing.T) {
+	data := readFixture(t, "keyframes.ts")
+	var segments []Segment
+	s := NewSegmenter(2*time.Second, func(seg Segment) {
+		segments = append(segments, seg)
+	})
+	// source is reopened in the middle of third segment
+	half := len(data) / 2 / PacketSize * PacketSize
+	s.Write(data[:half])
+	s.Discontinue()
+	s.Write(data)
+
+	if len(segments) < 4 {
+		t.Fatalf("got %d segments, want at least 4", len(segments))
+	}
+	if segments[2].Discontinuity || segments[2].Duration >= 2*time.Second {
+		t.Errorf("interrupted segment: got %v discontinuity %v", segments[2].Duration, segments[2].Discontinuity)
+	}
+	if !segments[3].Discontinuity {
+		t.Errorf("first segment of reopened stream is not discontinuous")
+	}
+	for _, seg := range segments[4:] {
+		if seg.Discontinuity {
+			t.Errorf("segment after reopened one is discontinuous")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+# Generates transport stream fixtures of mpegts tests: python3 generate.py internal/mpegts/testdata
+# Streams have PAT, PMT, H.264 video with PCR on PID 0x100 and AAC audio on PID 0x101, 25 frames per second
+# with keyframe every gop seconds.
+import struct, sys
+def crc32(data):
+    crc=0xFFFFFFFF
+    for b in data:
+        crc^=b<<24
+        for _ in range(8):
+            crc=((crc<<1)^0x04C11DB7 if crc&0x80000000 else crc<<1)&0xFFFFFFFF
+    return crc
+class Mux:
+    def __init__(s): s.cc={}; s.out=bytearray()
+    def next_cc(s,pid):
+        c=s.cc.get(pid,0); s.cc[pid]=(c+1)&0xF; return c
+    def psi(s,pid,section):
+        sec=bytes([0])+section+struct.pack('>I',crc32(section))
+        p=bytes([0x47,0x40|(pid>>8),pid&0xFF,0x10|s.next_cc(pid)])+sec
+        s.out+=p+b'\xff'*(188-len(p))
+    def pat(s):
+        body=struct.pack('>HBBB',1,0xC1,0,0)+struct.pack('>HH',1,0xE000|0x1000)
+        s.psi(0,bytes([0x00])+struct.pack('>H',0xB000|(len(body)+4))+body)
+    def pmt(s,version=0,streams=((0x1B,0x100),(0x0F,0x101))):
+        es=b''.join(bytes([t])+struct.pack('>HH',0xE000|pid,0xF000) for t,pid in streams)
+        body=struct.pack('>HBBB',1,0xC1|(version<<1),0,0)+struct.pack('>HH',0xE000|0x100,0xF000)+es
+        s.psi(0x1000,bytes([0x02])+struct.pack('>H',0xB000|(len(body)+4))+body)
+    def pes(s,pid,sid,pts,es,key=False,pcr=False,dts=None):
+        if dts is None:
+            hdr=bytes([0,0,1,sid,0,0,0x80,0x80,5])+ts(pts,2)
+        else:
+            hdr=bytes([0,0,1,sid,0,0,0x80,0xC0,10])+ts(pts,3)+ts(dts,1)
+        data=hdr+es; first=True
+        while data:
+            af=None
+            if first and (pcr or key):
+                af=bytes([(0x40 if key else 0)|(0x10 if pcr else 0)])
+                if pcr:
+                    base=(dts if dts is not None else pts)-9000
+                    af+=struct.pack('>IH',(base>>1)&0xFFFFFFFF,((base&1)<<15)|0x7E00)
+            room=184-(1+len(af) if af is not None else 0)
+            if len(data)<room:
+                stuff=room-len(data)
+                if af is None:
+                    af=b'' if stuff==1 else bytes([0])+b'\xff'*(stuff-2)
+                else:
+                    af+=b'\xff'*stuff
+            head=b'' if af is None else bytes([len(af)])+af
+            afc=0x10 if af is None else 0x30
+            chunk=data[:184-len(head)]; data=data[len(chunk):]
+            s.out+=bytes([0x47,(0x40 if first else 0)|(pid>>8),pid&0xFF,afc|s.next_cc(pid)])+head+chunk
+            first=False
+def ts(v,marker):
+    return bytes([(marker<<4)|(((v>>30)&7)<<1)|1,(v>>22)&0xFF,(((v>>15)&0x7F)<<1)|1,(v>>7)&0xFF,((v&0x7F)<<1)|1])
+def frame(key):
+    if key:
+        return b'\x00\x00\x00\x01\x09\xf0\x00\x00\x00\x01\x67\x42\x00\x1e\x00\x00\x00\x01\x68\xce\x00\x00\x01\x65'+b'\x88'*300
+    return b'\x00\x00\x00\x01\x09\xf0\x00\x00\x00\x01\x41'+b'\x9a'*90
+def stream(seconds,gop,start=90000,jumps={},pmt_change=None,fps=25):
+    m=Mux(); offset=0
+    for f in range(seconds*fps):
+        offset+=jumps.get(f,0)
+        key=f==0 or f in jumps or (gop>0 and f%(gop*fps)==0)
+        if f%10==0 or f in jumps or f==pmt_change:
+            m.pat(); m.pmt(1 if pmt_change is not None and f>=pmt_change else 0)
+        dts=start+offset+f*3600
+        m.pes(0x100,0xE0,dts+3600,frame(key),key=key,pcr=True,dts=dts)
+        if f%2==0:
+            m.pes(0x101,0xC0,dts,b'\xff\xf1\x50\x80'+b'\x21'*60)
+    return bytes(m.out)
+def audio(seconds):
+    m=Mux()
+    for f in range(seconds*25):
+        if f%10==0: m.pat(); m.pmt(0,((0x0F,0x101),))
+        m.pes(0x101,0xC0,90000+f*3600,b'\xff\xf1\x50\x80'+b'\x21'*60,pcr=True)
+    return bytes(m.out)
+d=sys.argv[1]
+open(d+'/keyframes.ts','wb').write(stream(9,2))
+open(d+'/nokeyframes.ts','wb').write(stream(9,0))
+open(d+'/gap.ts','wb').write(stream(9,2,jumps={100:30*90000}))
+open(d+'/stall.ts','wb').write(stream(9,2,jumps={60:8*90000}))
+open(d+'/restart.ts','wb').write(stream(9,2,jumps={100:-4*90000}))
+open(d+'/wrap.ts','wb').write(stream(9,2,start=(1<<33)-4*90000))
+open(d+'/pmtchange.ts','wb').write(stream(9,2,pmt_change=110))
+open(d+'/audio.ts','wb').write(audio(5))
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+
+	"github.com/gorilla/mux"
+)
+
+// modes of catchup attribute
+const (
+	catchupDefault   = "default"
+	catchupAppend    = "append"
+	catchupShift     = "shift"
+	catchupFlussonic = "flussonic"
+	catchupXtream    = "xc"
+)
+
+// catchupQuery is query of catch-up urls in rewritten playlists, players replace placeholders by start and end of programme
+const catchupQuery = "start={utc}&end={utcend}"
+
+var (
+	// xtreamStreamURL matches live stream url of Xtream Codes panel: host, user, password, stream id and extension
+	xtreamStreamURL = regexp.MustCompile(`^(https?://[^/]+)/(?:live/)?([^/]+)/([^/]+)/([^/.]+)(\.[a-z0-9]+)?$`)
+	// flussonicStreamURL matches live stream url of Flussonic server: stream path, playlist name or mpegts and query
+	flussonicStreamURL = regexp.MustCompile(`^(https?://[^/]+/.*)/([^/]*)(mpegts|\.m3u8)(\?.+)?$`)
+	// catchupPlaceholder matches {name}, ${name} and {name:argument} placeholders of catch-up templates
+	catchupPlaceholder = regexp.MustCompile(`\$?\{([a-zA-Z]+)(?::([^{}]*))?\}`)
+)
+
+// catchupSource is catch-up of channel, it is carried encoded in catch-up urls of rewritten playlists
+type catchupSource struct {
+	mode string
+	// template is catchup-source attribute
+	template string
+	// url is real url of live stream of channel
+	url string
+}
+
+// parseCatchup returns catch-up of channel by attributes of its #EXTINF entry.
+// Xtream Codes streams with timeshift or tvg-rec attribute have catch-up even without catchup attribute.
+func parseCatchup(attrs map[string]string, streamURL string) (catchupSource, bool) {
+	s := catchupSource{mode: strings.ToLower(attrs["catchup"]), template: attrs["catchup-source"], url: streamURL}
+	switch s.mode {
+	case "":
+		switch {
+		case s.template != "":
+			s.mode = catchupDefault
+		case xtreamDays(attrs) != "":
+			s.mode = catchupXtream
+		default:
+			return s, false
+		}
+	case "fs", "flussonic-hls", "flussonic-ts":
+		s.mode = catchupFlussonic
+	case catchupDefault, catchupAppend, catchupShift, catchupFlussonic, catchupXtream:
+	default:
+		return s, false
+	}
+
+	switch s.mode {
+	case catchupDefault, catchupAppend:
+		return s, s.template != ""
+	case catchupFlussonic:
+		return s, flussonicStreamURL.MatchString(streamURL)
+	case catchupXtream:
+		return s, xtreamStreamURL.MatchString(streamURL)
+	}
+	return s, true
+}
+
+// xtreamDays returns archive days of Xtream Codes entry, panels write them to timeshift or tvg-rec attribute
+func xtreamDays(attrs map[string]string) string {
+	for _, attr := range [...]string{"timeshift", "tvg-rec"} {
+		if days, err := strconv.Atoi(attrs[attr]); err == nil && days > 0 {
+			return attrs[attr]
+		}
+	}
+	return ""
+}
+
+func (s catchupSource) encode(listName string) (string, error) {
+	v := url.Values{}
+	v.Set("mode", s.mode)
+	v.Set("template", s.template)
+	v.Set("url", s.url)
+	return urlconvert.EncodeForList(v.Encode(), listName)
+}
+
+func decodeCatchupSource(encoded, listName string) (catchupSource, error) {
+	decoded, err := urlconvert.DecodeForList(encoded, listName)
+	if err != nil {
+		return catchupSource{}, err
+	}
+	v, err := url.ParseQuery(decoded)
+	if err != nil {
+		return catchupSource{}, err
+	}
+	return catchupSource{mode: v.Get("mode"), template: v.Get("template"), url: v.Get("url")}, nil
+}
+
+// archiveURL returns real url of archive of channel between start and end, dates of placeholders are in loc
+func (s catchupSource) archiveURL(start, end, now time.Time, loc *time.Location) string {
+	template := s.template
+	switch s.mode {
+	case catchupAppend:
+		template = s.url + s.template
+		if strings.HasPrefix(s.template, "?") && strings.Contains(s.url, "?") {
+			template = s.url + "&" + s.template[1:]
+		}
+	case catchupShift:
+		sep := "?"
+		if strings.Contains(s.url, "?") {
+			sep = "&"
+		}
+		template = s.url + sep + "utc={utc}&lutc={lutc}"
+	case catchupFlussonic:
+		m := flussonicStreamURL.FindStringSubmatch(s.url)
+		switch {
+		case m[3] == "mpegts":
+			template = m[1] + "/timeshift_abs-{utc}.ts" + m[4]
+		case m[2] == "index":
+			template = m[1] + "/timeshift_rel-{offset:1}.m3u8" + m[4]
+		default:
+			template = m[1] + "/" + m[2] + "-{utc}-{duration}.m3u8" + m[4]
+		}
+	case catchupXtream:
+		m := xtreamStreamURL.FindStringSubmatch(s.url)
+		ext := ".ts"
+		if m[5] == ".m3u8" {
+			ext = m[5]
+		}
+		template = m[1] + "/timeshift/" + m[2] + "/" + m[3] + "/{duration:60}/{Y}-{m}-{d}:{H}-{M}/" + m[4] + ext
+	}
+	// relative catchup-source of default mode is resolved against stream url
+	return resolveURL(s.url, expandCatchupTemplate(template, start.In(loc), end.In(loc), now.In(loc)))
+}
+
+// expandCatchupTemplate replaces placeholders of catch-up template, unknown placeholders are kept.
+// Times are unix timestamps or formatted by argument like {utc:Y-m-d H:M:S}, duration and offset
+// are seconds divided by argument like {duration:60}.
+func expandCatchupTemplate(template string, start, end, now time.Time) string {
+	return catchupPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := catchupPlaceholder.FindStringSubmatch(placeholder)
+		name, arg := m[1], m[2]
+		switch name {
+		case "utc", "start":
+			return formatCatchupTime(start, arg)
+		case "utcend", "end":
+			return formatCatchupTime(end, arg)
+		case "lutc", "now", "timestamp":
+			return formatCatchupTime(now, arg)
+		case "duration":
+			return divideSeconds(end.Sub(start), arg)
+		case "offset":
+			return divideSeconds(now.Sub(start), arg)
+		case "Y", "m", "d", "H", "M", "S":
+			if arg == "" {
+				return formatCatchupTime(start, name)
+			}
+		}
+		return placeholder
+	})
+}
+
+// formatCatchupTime returns unix timestamp of t or t formatted by letters Y, m, d, H, M and S of format
+func formatCatchupTime(t time.Time, format string) string {
+	if format == "" {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	var b strings.Builder
+	for _, r := range format {
+		switch r {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func divideSeconds(d time.Duration, divisor string) string {
+	seconds := int64(d / time.Second)
+	if n, err := strconv.ParseInt(divisor, 10, 64); err == nil && n > 0 {
+		// archives are requested in whole units, so partial unit is rounded up
+		return strconv.FormatInt((seconds+n-1)/n, 10)
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// catchupWindow returns start and end of requested archive from unix timestamps of start and end or duration in seconds,
+// archive without end lasts until now
+func catchupWindow(q url.Values, now time.Time) (time.Time, time.Time, error) {
+	startUnix, err := strconv.ParseInt(q.Get("start"), 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid start " + q.Get("start"))
+	}
+	start := time.Unix(startUnix, 0)
+	end := now
+	if endUnix, err := strconv.ParseInt(q.Get("end"), 10, 64); err == nil {
+		end = time.Unix(endUnix, 0)
+	} else if duration, err := strconv.ParseInt(q.Get("duration"), 10, 64); err == nil {
+		end = start.Add(time.Duration(duration) * time.Second)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, errors.New("Archive ends before it starts")
+	}
+	return start, end, nil
+}
+
+// catchupLocation returns time zone of catch-up urls of list
+func catchupLocation(list config.List) *time.Location {
+	if list.CatchupTimezone != "" {
+		if loc, err := time.LoadLocation(list.CatchupTimezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// handleCatchupRequest expands catch-up template of channel by requested times and redirects to proxy url of archive
+func handleCatchupRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	list, err := config.GetListFromConfig(listName)
+	if err != nil {
+		logger.Warn(err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	source, err := decodeCatchupSource(vars["source"], listName)
+	if err != nil {
+		logger.Warn("Invalid catch-up source of list " + listName + ": " + err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	start, end, err := catchupWindow(r.URL.Query(), now)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	archiveURL := source.archiveURL(start, end, now, catchupLocation(list))
+	proxyURL, err := urlconvert.ConvertURLtoProxyURL(archiveURL, config.GetConfig().App.URL, listName)
+	if err != nil {
+		logger.Warn(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Debug("Catch-up of list " + listName + ": " + archiveURL)
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	w.Header().Set("location", proxyURL)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	catchupStart = time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	catchupEnd   = catchupStart.Add(time.Hour)
+	catchupNow   = catchupStart.Add(2 * time.Hour)
+)
+
+func TestExpandCatchupTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "unix times", template: "{utc}-{utcend}", want: "1704139200-1704142800"},
+		{name: "aliases", template: "${start}/${end}/{lutc}/{now}/{timestamp}", want: "1704139200/1704142800/1704146400/1704146400/1704146400"},
+		{name: "formatted time", template: "{utc:Y-m-d H:M:S}", want: "2024-01-01 20:00:00"},
+		{name: "date letters", template: "{Y}{m}{d}-{H}{M}{S}", want: "20240101-200000"},
+		{name: "duration", template: "{duration} {duration:60}", want: "3600 60"},
+		{name: "offset rounded up", template: "{offset} {offset:7000}", want: "7200 2"},
+		{name: "unknown placeholders", template: "{foo}/{Y:x}", want: "{foo}/{Y:x}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandCatchupTemplate(tt.template, catchupStart, catchupEnd, catchupNow); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		source catchupSource
+		loc    *time.Location
+		want   string
+	}{
+		{
+			name:   "default absolute",
+			source: catchupSource{mode: catchupDefault, template: "http://archive.test/{start}-{end}", url: "http://provider.test/live/1.m3u8"},
+			want:   "http://archive.test/1704139200-1704142800",
+		},
+		{
+			name:   "default relative",
+			source: catchupSource{mode: catchupDefault, template: "archive/{utc}.m3u8", url: "http://provider.test/live/1.m3u8"},
+			want:   "http://provider.test/live/archive/1704139200.m3u8",
+		},
+		{
+			name:   "append to url with query",
+			source: catchupSource{mode: catchupAppend, template: "?utc={utc}", url: "http://provider.test/1.m3u8?token=a"},
+			want:   "http://provider.test/1.m3u8?token=a&utc=1704139200",
+		},
+		{
+			name:   "append",
+			source: catchupSource{mode: catchupAppend, template: "?utc={utc}&lutc={lutc}", url: "http://provider.test/1.m3u8"},
+			want:   "http://provider.test/1.m3u8?utc=1704139200&lutc=1704146400",
+		},
+		{
+			name:   "shift",
+			source: catchupSource{mode: catchupShift, url: "http://provider.test/1.ts"},
+			want:   "http://provider.test/1.ts?utc=1704139200&lutc=1704146400",
+		},
+		{
+			name:   "flussonic mpegts",
+			source: catchupSource{mode: catchupFlussonic, url: "http://flussonic.test/ch1/mpegts?token=x"},
+			want:   "http://flussonic.test/ch1/timeshift_abs-1704139200.ts?token=x",
+		},
+		{
+			name:   "flussonic index",
+			source: catchupSource{mode: catchupFlussonic, url: "http://flussonic.test/ch1/index.m3u8"},
+			want:   "http://flussonic.test/ch1/timeshift_rel-7200.m3u8",
+		},
+		{
+			name:   "flussonic playlist",
+			source: catchupSource{mode: catchupFlussonic, url: "http://flussonic.test/ch1/video.m3u8"},
+			want:   "http://flussonic.test/ch1/video-1704139200-3600.m3u8",
+		},
+		{
+			name:   "xtream",
+			source: catchupSource{mode: catchupXtream, url: "http://xtream.test:8080/live/user/pass/123.ts"},
+			want:   "http://xtream.test:8080/timeshift/user/pass/60/2024-01-01:20-00/123.ts",
+		},
+		{
+			name:   "xtream hls in time zone",
+			source: catchupSource{mode: catchupXtream, url: "http://xtream.test/user/pass/5.m3u8"},
+			loc:    time.FixedZone("CET", 3600),
+			want:   "http://xtream.test/timeshift/user/pass/60/2024-01-01:21-00/5.m3u8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := tt.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			if got := tt.source.archiveURL(catchupStart, catchupEnd, catchupNow, loc); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCatchup(t *testing.T) {
+	tests := []struct {
+		name      string
+		attrs     map[string]string
+		streamURL string
+		mode      string
+		ok        bool
+	}{
+		{name: "source without mode", attrs: map[string]string{"catchup-source": "?utc={utc}"}, streamURL: "http://provider.test/1.ts", mode: catchupDefault, ok: true},
+		{name: "xtream timeshift", attrs: map[string]string{"timeshift": "3"}, streamURL: "http://xtream.test/live/u/p/1.ts", mode: catchupXtream, ok: true},
+		{name: "xtream with other url", attrs: map[string]string{"tvg-rec": "3"}, streamURL: "http://provider.test/channel", mode: catchupXtream},
+		{name: "flussonic alias", attrs: map[string]string{"catchup": "fs"}, streamURL: "http://flussonic.test/ch1/index.m3u8", mode: catchupFlussonic, ok: true},
+		{name: "append without source", attrs: map[string]string{"catchup": "append"}, streamURL: "http://provider.test/1.ts", mode: catchupAppend},
+		{name: "unknown mode", attrs: map[string]string{"catchup": "vod"}, streamURL: "http://provider.test/1.ts", mode: "vod"},
+		{name: "no catch-up", attrs: map[string]string{"timeshift": "0"}, streamURL: "http://provider.test/1.ts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ok := parseCatchup(tt.attrs, tt.streamURL)
+			if ok != tt.ok || s.mode != tt.mode {
+				t.Errorf("got %s %v, want %s %v", s.mode, ok, tt.mode, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCatchupWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		start time.Time
+		end   time.Time
+		err   bool
+	}{
+		{name: "start and end", query: "start=1704139200&end=1704142800", start: catchupStart, end: catchupEnd},
+		{name: "duration", query: "start=1704139200&duration=1800", start: catchupStart, end: catchupStart.Add(30 * time.Minute)},
+		{name: "until now", query: "start=1704139200", start: catchupStart, end: catchupNow},
+		{name: "invalid start", query: "start={utc}&end=1704142800", err: true},
+		{name: "end before start", query: "start=1704142800&end=1704139200", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			start, end, err := catchupWindow(q, catchupNow)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("got %s - %s, want %s - %s", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
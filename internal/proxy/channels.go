@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+// channelIndexTTL is how long parsed playlist of list is used before it is fetched again
+const channelIndexTTL = 10 * time.Minute
+
+// channel is entry of list playlist
+type channel struct {
+	// ID is used in proxy urls, it is made of tvg-id or name
+	ID    string
+	Name  string
+	Group string
+	// URL is real url of provider stream
+	URL string
+	// Attrs are attributes of EXTINF line like tvg-id, tvg-logo or catchup
+	Attrs map[string]string
+}
+
+type channelIndex struct {
+	channels []channel
+	byID     map[string]int
+	// epgURL is url-tvg attribute of playlist header
+	epgURL  string
+	expires time.Time
+}
+
+var channelIndexes = make(map[string]*channelIndex)
+var channelIndexesMu sync.Mutex
+var channelFlights flightGroup
+var onceChannelIndex sync.Once
+
+var errChannelNotFound = errors.New("Channel not found")
+
+// getChannels returns channels of list playlist, playlist is fetched once for all concurrent callers and cached
+func getChannels(ctx context.Context, listName string) ([]channel, error) {
+	idx, err := getChannelIndex(ctx, listName)
+	if err != nil {
+		return nil, err
+	}
+	return idx.channels, nil
+}
+
+// getChannel returns channel of list by its id
+func getChannel(ctx context.Context, listName, channelID string) (channel, error) {
+	idx, err := getChannelIndex(ctx, listName)
+	if err != nil {
+		return channel{}, err
+	}
+	i, ok := idx.byID[channelID]
+	if !ok {
+		return channel{}, errChannelNotFound
+	}
+	return idx.channels[i], nil
+}
+
+// getEPGURL returns url of XMLTV guide of list, configured one is preferred over url-tvg of playlist
+func getEPGURL(ctx context.Context, listName string) (string, error) {
+	list, err := config.GetListFromConfig(listName)
+	if err != nil {
+		return "", err
+	}
+	if list.EPG != "" {
+		return list.EPG, nil
+	}
+	idx, err := getChannelIndex(ctx, listName)
+	if err != nil {
+		return "", err
+	}
+	if idx.epgURL == "" {
+		return "", errors.New("List " + listName + " has no epg")
+	}
+	return idx.epgURL, nil
+}
+
+func getChannelIndex(ctx context.Context, listName string) (*channelIndex, error) {
+	onceChannelIndex.Do(func() {
+		// list url or headers can change
+		config.OnChange(func(old, new config.Config) {
+			channelIndexesMu.Lock()
+			channelIndexes = make(map[string]*channelIndex)
+			channelIndexesMu.Unlock()
+		})
+	})
+
+	channelIndexesMu.Lock()
+	idx, ok := channelIndexes[listName]
+	channelIndexesMu.Unlock()
+	if ok && time.Now().Before(idx.expires) {
+		return idx, nil
+	}
+
+	v, err := channelFlights.do(ctx, listName, func() (interface{}, error) {
+		return fetchChannelIndex(listName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*channelIndex), nil
+}
+
+// fetchChannelIndex fetches playlist of list on connection slot, free slot is taken preemptibly so viewer
+// waiting for it stops the fetch, otherwise fetch waits for slot like viewer
+func fetchChannelIndex(listName string) (*channelIndex, error) {
+	listURL, err := config.GetListURL(listName)
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	releaseConnection, ok := tryLockListConnection(listName, stop)
+	if !ok {
+		if releaseConnection, err = lockListConnection(listName); err != nil {
+			return nil, errors.New("Too many connections for list " + listName)
+		}
+	}
+	defer releaseConnection()
+
+	client, err := GetListClient(listName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getFollowingRedirects(ctx, client, listURL, listName)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode) + " of list " + listName)
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return nil, err
+	}
+
+	channels, epgURL, err := parseChannels(resp.Body, resp.Request.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	idx := &channelIndex{channels: channels, byID: make(map[string]int, len(channels)), epgURL: epgURL, expires: time.Now().Add(channelIndexTTL)}
+	for i, ch := range channels {
+		idx.byID[ch.ID] = i
+	}
+
+	channelIndexesMu.Lock()
+	channelIndexes[listName] = idx
+	channelIndexesMu.Unlock()
+	logger.Debug("Channels of list " + listName + " indexed: " + strconv.Itoa(len(channels)))
+
+	return idx, nil
+}
+
+// parseChannels parses EXTINF entries of m3u playlist, relative stream urls are resolved against baseURL.
+// First url of url-tvg or x-tvg-url attribute of #EXTM3U header is returned as epg url.
+func parseChannels(body io.Reader, baseURL string) ([]channel, string, error) {
+	br := bufio.NewReader(body)
+	channels := []channel{}
+	ids := make(map[string]int)
+	epgURL := ""
+	var current *channel
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTM3U") && epgURL == "":
+			header := parseExtinf("#EXTINF:" + strings.TrimPrefix(line, "#EXTM3U"))
+			for _, attr := range [...]string{"url-tvg", "x-tvg-url"} {
+				if urls := strings.Split(header.Attrs[attr], ","); epgURL == "" && urls[0] != "" {
+					epgURL = resolveURL(baseURL, strings.TrimSpace(urls[0]))
+				}
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			ch := parseExtinf(line)
+			current = &ch
+		case strings.HasPrefix(line, "#EXTGRP:") && current != nil && current.Group == "":
+			current.Group = strings.TrimSpace(line[len("#EXTGRP:"):])
+		case line != "" && line[0] != '#' && current != nil:
+			current.URL = resolveURL(baseURL, line)
+			current.ID = uniqueChannelID(ids, current)
+			channels = append(channels, *current)
+			current = nil
+		}
+		if err == io.EOF {
+			return channels, epgURL, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// parseExtinf parses attributes and name of #EXTINF:-1 tvg-id="id" group-title="group",Name line
+func parseExtinf(line string) channel {
+	ch := channel{Attrs: make(map[string]string)}
+	attrs, nameStart := scanExtinf(line)
+	for _, a := range attrs {
+		ch.Attrs[a.key] = a.value(line)
+	}
+
+	ch.Name = strings.TrimSpace(strings.TrimPrefix(line[nameStart:], ","))
+	if ch.Name == "" {
+		ch.Name = ch.Attrs["tvg-name"]
+	}
+	ch.Group = ch.Attrs["group-title"]
+	return ch
+}
+
+// extinfAttr is span of attribute of #EXTINF line, span of value includes its quotes
+type extinfAttr struct {
+	key        string
+	start, end int
+}
+
+func (a extinfAttr) value(line string) string {
+	return strings.Trim(line[a.start:a.end], `"`)
+}
+
+// scanExtinf returns attributes of #EXTINF line with lower case names and offset where attributes end
+func scanExtinf(line string) ([]extinfAttr, int) {
+	attrs := []extinfAttr{}
+	pos := len("#EXTINF:")
+	// skip duration
+	if i := strings.IndexAny(line[pos:], " ,"); i >= 0 {
+		pos += i
+	} else {
+		return attrs, len(line)
+	}
+
+	for {
+		for pos < len(line) && (line[pos] == ' ' || line[pos] == '\t') {
+			pos++
+		}
+		rest := line[pos:]
+		if rest == "" || rest[0] == ',' {
+			return attrs, pos
+		}
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 || strings.IndexAny(rest[:eq], ", ") >= 0 {
+			// rest is name
+			return attrs, pos
+		}
+		a := extinfAttr{key: strings.ToLower(strings.TrimSpace(rest[:eq])), start: pos + eq + 1}
+		rest = rest[eq+1:]
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return attrs, a.start
+			}
+			a.end = a.start + end + 2
+		} else {
+			end := strings.IndexAny(rest, " ,")
+			if end < 0 {
+				end = len(rest)
+			}
+			a.end = a.start + end
+		}
+		attrs = append(attrs, a)
+		pos = a.end
+	}
+}
+
+// uniqueChannelID makes id of channel from tvg-id or name, duplicates get number suffix
+func uniqueChannelID(ids map[string]int, ch *channel) string {
+	id := slug(ch.Attrs["tvg-id"])
+	if id == "" {
+		id = slug(ch.Name)
+	}
+	if id == "" {
+		id = "channel"
+	}
+	ids[id]++
+	if n := ids[id]; n > 1 {
+		return id + "-" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// slug returns lower case words of letters and digits joined by dash
+func slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+// resolveURL resolves reference against base url, reference is returned unchanged when it can't be resolved
+func resolveURL(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	u, err := b.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
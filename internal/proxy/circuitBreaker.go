@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+const (
+	// halfOpenRetryAfter is suggested to clients rejected while trial request to host is running
+	halfOpenRetryAfter = time.Second
+	// breakerIdleTimeout removes closed breakers of hosts nobody requested for a while, with their metrics
+	breakerIdleTimeout = 30 * time.Minute
+	// breakerSweepInterval is how often idle breakers are removed
+	breakerSweepInterval = time.Minute
+)
+
+var errCircuitOpen = errors.New("Circuit of upstream host is open")
+
+type circuitState int
+
+// States of circuit breaker, values are reported in metrics
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitOpenError is returned for requests rejected by open circuit, retryAfter is time until host is tried again
+type circuitOpenError struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return "Circuit of upstream host " + e.host + " is open"
+}
+
+func (e *circuitOpenError) Is(target error) bool {
+	return target == errCircuitOpen
+}
+
+// hostBreaker is circuit breaker of one upstream host. Closed circuit counts consecutive connection failures,
+// open one rejects requests until openUntil, then half-open circuit lets single trial request decide.
+type hostBreaker struct {
+	mu          sync.Mutex
+	host        string
+	state       circuitState
+	failures    int
+	openTimeout time.Duration
+	openUntil   time.Time
+	trial       bool
+	lastUsed    time.Time
+	// totals are reported in metrics
+	totalFailures int64
+	rejected      int64
+}
+
+var hostBreakers = make(map[string]*hostBreaker)
+var hostBreakersMu sync.Mutex
+var lastBreakerSweep time.Time
+
+func getHostBreaker(host string) *hostBreaker {
+	now := time.Now()
+	hostBreakersMu.Lock()
+	defer hostBreakersMu.Unlock()
+	if now.Sub(lastBreakerSweep) >= breakerSweepInterval {
+		lastBreakerSweep = now
+		sweepHostBreakers(now)
+	}
+	b, ok := hostBreakers[host]
+	if !ok {
+		b = &hostBreaker{host: host, lastUsed: now}
+		hostBreakers[host] = b
+	}
+	return b
+}
+
+// sweepHostBreakers removes closed breakers idle for breakerIdleTimeout, must be called with hostBreakersMu held
+func sweepHostBreakers(now time.Time) {
+	for host, b := range hostBreakers {
+		b.mu.Lock()
+		idle := b.state == circuitClosed && now.Sub(b.lastUsed) >= breakerIdleTimeout
+		b.mu.Unlock()
+		if idle {
+			delete(hostBreakers, host)
+		}
+	}
+}
+
+// circuitRetryAfter reports if requests to host are rejected now, without starting trial request.
+// It lets handlers fail before they take connection slot.
+func circuitRetryAfter(host string) (time.Duration, bool) {
+	if config.GetConfig().Server.CircuitBreaker.Failures == 0 {
+		return 0, false
+	}
+	hostBreakersMu.Lock()
+	b, ok := hostBreakers[host]
+	hostBreakersMu.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == circuitOpen && time.Now().Before(b.openUntil):
+		b.rejected++
+		return time.Until(b.openUntil), true
+	case b.state == circuitHalfOpen && b.trial:
+		b.rejected++
+		return halfOpenRetryAfter, true
+	}
+	return 0, false
+}
+
+// allow reports if request can be sent, when open timeout is over the request becomes trial of half-open circuit
+func (b *hostBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastUsed = time.Now()
+	switch b.state {
+	case circuitOpen:
+		if now := time.Now(); now.Before(b.openUntil) {
+			b.rejected++
+			return b.openUntil.Sub(now), false
+		}
+		b.state = circuitHalfOpen
+		b.trial = true
+		logger.Info("Circuit of upstream host " + b.host + " is half-open, trying it")
+	case circuitHalfOpen:
+		if b.trial {
+			b.rejected++
+			return halfOpenRetryAfter, false
+		}
+		b.trial = true
+	}
+	return 0, true
+}
+
+func (b *hostBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitClosed {
+		logger.Info("Circuit of upstream host " + b.host + " is closed")
+	}
+	b.state = circuitClosed
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *hostBreaker) failure(c config.CircuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.totalFailures++
+	switch b.state {
+	case circuitClosed:
+		b.failures++
+		if b.failures < c.Failures {
+			return
+		}
+		b.openTimeout = c.OpenTimeout
+		logger.Warn("Circuit of upstream host " + b.host + " is open after " + strconv.Itoa(b.failures) +
+			" failures, next try in " + b.openTimeout.String())
+	case circuitHalfOpen:
+		// backoff of host which keeps failing
+		b.openTimeout *= 2
+		if b.openTimeout > c.MaxOpenTimeout {
+			b.openTimeout = c.MaxOpenTimeout
+		}
+		logger.Warn("Circuit of upstream host " + b.host + " is open again, next try in " + b.openTimeout.String())
+	default:
+		// request sent before circuit opened
+		return
+	}
+	b.state = circuitOpen
+	b.trial = false
+	b.openUntil = time.Now().Add(b.openTimeout)
+}
+
+// abort ends trial request which was canceled by client before host answered
+func (b *hostBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.trial = false
+	}
+}
+
+// circuitTransport passes requests through circuit breaker of their host.
+// Only connection failures and timeouts count, error statuses are answers of working host.
+type circuitTransport struct {
+	next http.RoundTripper
+}
+
+func (t *circuitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := config.GetConfig().Server.CircuitBreaker
+	if c.Failures == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	b := getHostBreaker(req.URL.Host)
+	if retryAfter, ok := b.allow(); !ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &circuitOpenError{host: req.URL.Host, retryAfter: retryAfter}
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err == nil:
+		b.success()
+	case errors.Is(req.Context().Err(), context.Canceled):
+		// client went away, deadline of request context is client timeout and counts as failure of host
+		b.abort()
+	default:
+		b.failure(c)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes idle connections of wrapped transport
+func (t *circuitTransport) CloseIdleConnections() {
+	if tr, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// writeCircuitOpen responds to request rejected by open circuit
+func writeCircuitOpen(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// circuitSnapshot is state of host breaker reported in metrics
+type circuitSnapshot struct {
+	host          string
+	state         circuitState
+	totalFailures int64
+	rejected      int64
+}
+
+// circuitSnapshots returns states of all host breakers sorted by host
+func circuitSnapshots() []circuitSnapshot {
+	hostBreakersMu.Lock()
+	breakers := make([]*hostBreaker, 0, len(hostBreakers))
+	for _, b := range hostBreakers {
+		breakers = append(breakers, b)
+	}
+	hostBreakersMu.Unlock()
+
+	snapshots := make([]circuitSnapshot, 0, len(breakers))
+	for _, b := range breakers {
+		b.mu.Lock()
+		snapshots = append(snapshots, circuitSnapshot{host: b.host, state: b.state, totalFailures: b.totalFailures, rejected: b.rejected})
+		b.mu.Unlock()
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].host < snapshots[j].host })
+	return snapshots
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+)
+
+func TestHostBreaker(t *testing.T) {
+	c := config.CircuitBreaker{Failures: 3, OpenTimeout: 10 * time.Second, MaxOpenTimeout: 25 * time.Second}
+	opened := []string{"fail", "fail", "fail"}
+	tests := []struct {
+		name string
+		// steps are allow and deny checking result of allow, fail, succeed, abort and expire ending open timeout
+		steps       []string
+		state       circuitState
+		openTimeout time.Duration
+	}{
+		{name: "failures below limit", steps: []string{"fail", "fail", "allow"}, state: circuitClosed},
+		{name: "opens after failures", steps: append(opened, "deny"), state: circuitOpen, openTimeout: 10 * time.Second},
+		{name: "success resets failures", steps: []string{"fail", "fail", "succeed", "fail", "fail", "allow"}, state: circuitClosed},
+		{name: "single trial", steps: append(opened, "expire", "allow", "deny"), state: circuitHalfOpen, openTimeout: 10 * time.Second},
+		{name: "trial success closes", steps: append(opened, "expire", "allow", "succeed", "allow", "allow"), state: circuitClosed, openTimeout: 10 * time.Second},
+		{name: "trial failure doubles timeout", steps: append(opened, "expire", "allow", "fail", "deny"), state: circuitOpen, openTimeout: 20 * time.Second},
+		{
+			name:        "timeout limited",
+			steps:       append(opened, "expire", "allow", "fail", "expire", "allow", "fail"),
+			state:       circuitOpen,
+			openTimeout: 25 * time.Second,
+		},
+		{name: "aborted trial", steps: append(opened, "expire", "allow", "abort", "allow", "deny"), state: circuitHalfOpen, openTimeout: 10 * time.Second},
+		{name: "failure of earlier request", steps: append(opened, "fail", "deny"), state: circuitOpen, openTimeout: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &hostBreaker{host: "provider.test"}
+			for i, step := range tt.steps {
+				switch step {
+				case "allow", "deny":
+					if _, ok := b.allow(); ok != (step == "allow") {
+						t.Fatalf("step %d: got allow %v, want %s", i, ok, step)
+					}
+				case "fail":
+					b.failure(c)
+				case "succeed":
+					b.success()
+				case "abort":
+					b.abort()
+				case "expire":
+					b.openUntil = time.Now().Add(-time.Second)
+				}
+			}
+			if b.state != tt.state || b.openTimeout != tt.openTimeout {
+				t.Errorf("got %s %s, want %s %s", b.state, b.openTimeout, tt.state, tt.openTimeout)
+			}
+		})
+	}
+}
+
+func TestSweepHostBreakers(t *testing.T) {
+	now := time.Now()
+	hostBreakersMu.Lock()
+	defer hostBreakersMu.Unlock()
+	saved := hostBreakers
+	defer func() { hostBreakers = saved }()
+
+	hostBreakers = map[string]*hostBreaker{
+		"idle.test":   {state: circuitClosed, lastUsed: now.Add(-breakerIdleTimeout)},
+		"recent.test": {state: circuitClosed, lastUsed: now.Add(-breakerIdleTimeout + time.Second)},
+		"open.test":   {state: circuitOpen, lastUsed: now.Add(-breakerIdleTimeout)},
+		"trial.test":  {state: circuitHalfOpen, lastUsed: now.Add(-breakerIdleTimeout)},
+	}
+	sweepHostBreakers(now)
+
+	hosts := []string{}
+	for host := range hostBreakers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	if want := []string{"open.test", "recent.test", "trial.test"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got %v, want %v", hosts, want)
+	}
+}
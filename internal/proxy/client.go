@@ -1,32 +1,194 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
-	"log"
+	"crypto/x509"
+	"errors"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+const (
+	// idleConnTimeout closes keep-alive connections to provider nobody used for a while
+	idleConnTimeout = 90 * time.Second
+	// loginRetryDelay is minimal time between login attempts of list
+	loginRetryDelay = 10 * time.Second
 )
 
 var onceClient sync.Once
-var httpClient *http.Client
+var clientMu sync.Mutex
+var httpClients = make(map[string]*listClient)
 
-// GetClient returns initialized http client
-func GetClient() *http.Client {
+type listClient struct {
+	client *http.Client
+	// loginClient requests login page without loginTransport, so responses of login don't expire it
+	loginClient *http.Client
+	loginURL    string
+
+	logins    flightGroup
+	loginMu   sync.Mutex
+	loggedIn  bool
+	lastLogin time.Time
+}
+
+// GetListClient returns initialized http client for requests to list provider
+func GetListClient(listName string) (*http.Client, error) {
 	onceClient.Do(func() {
-		initClient()
-		log.Println("Client initialized")
+		// clients are rebuilt with new settings on next use after config reload,
+		// idle connections of old ones are closed, connections of running requests expire after idleConnTimeout
+		config.OnChange(func(old, new config.Config) {
+			clientMu.Lock()
+			oldClients := httpClients
+			httpClients = make(map[string]*listClient)
+			clientMu.Unlock()
+			for _, lc := range oldClients {
+				lc.client.CloseIdleConnections()
+			}
+		})
+	})
+
+	list, err := config.GetListFromConfig(listName)
+	if err != nil {
+		return nil, err
+	}
+
+	clientMu.Lock()
+	lc, ok := httpClients[listName]
+	if !ok {
+		client, err := initClient(list)
+		if err != nil {
+			clientMu.Unlock()
+			return nil, err
+		}
+		lc = &listClient{client: client, loginURL: list.Cookies.LoginURL}
+		if lc.loginURL != "" {
+			loginClient := *client
+			lc.loginClient = &loginClient
+			client.Transport = &loginTransport{next: client.Transport, lc: lc, listName: listName}
+		}
+		httpClients[listName] = lc
+		logger.Debug("Client initialized for list " + listName)
+	}
+	clientMu.Unlock()
+
+	// requests wait until login page fills cookie jar
+	if lc.loginURL != "" {
+		lc.ensureLogin(listName)
+	}
+
+	return lc.client, nil
+}
+
+// ensureLogin logs in when client isn't logged in, failed login is tried again after loginRetryDelay.
+// Concurrent requests wait for one login, loginMu isn't held while it runs.
+func (lc *listClient) ensureLogin(listName string) {
+	if !lc.needsLogin() {
+		return
+	}
+	lc.logins.do(context.Background(), listName, func() (interface{}, error) {
+		if !lc.needsLogin() {
+			return nil, nil
+		}
+		loggedIn := login(lc.loginClient, lc.loginURL, listName)
+		lc.loginMu.Lock()
+		lc.loggedIn = loggedIn
+		lc.lastLogin = time.Now()
+		lc.loginMu.Unlock()
+		return nil, nil
 	})
+}
+
+func (lc *listClient) needsLogin() bool {
+	lc.loginMu.Lock()
+	defer lc.loginMu.Unlock()
+	return !lc.loggedIn && time.Since(lc.lastLogin) >= loginRetryDelay
+}
+
+// expireLogin makes next request of list log in again
+func (lc *listClient) expireLogin(listName string) {
+	lc.loginMu.Lock()
+	defer lc.loginMu.Unlock()
+	if lc.loggedIn {
+		logger.Info("Session of list " + listName + " expired, logging in again")
+		lc.loggedIn = false
+		lc.lastLogin = time.Time{}
+	}
+}
+
+// login requests login page of list so its cookies are stored in client jar, reports if it succeeded
+func login(client *http.Client, loginURL, listName string) bool {
+	resp, err := getFollowingRedirects(context.Background(), client, loginURL, listName)
+	if err != nil {
+		logger.Error("Login to list " + listName + " failed: " + err.Error())
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		logger.Error("Login to list " + listName + " failed, status " + resp.Status)
+		return false
+	}
+	logger.Info("Logged in to list " + listName + ", status " + resp.Status)
+	return true
+}
 
-	return httpClient
+// loginTransport expires login of list when provider rejects request or redirects it to login page
+type loginTransport struct {
+	next     http.RoundTripper
+	lc       *listClient
+	listName string
 }
 
-func initClient() {
+func (t *loginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || isLoginURL(req.URL, t.lc.loginURL) {
+		return resp, err
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		t.lc.expireLogin(t.listName)
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if location, err := req.URL.Parse(resp.Header.Get("location")); err == nil && isLoginURL(location, t.lc.loginURL) {
+			t.lc.expireLogin(t.listName)
+		}
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes idle connections of wrapped transport
+func (t *loginTransport) CloseIdleConnections() {
+	if tr, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// isLoginURL reports if u is login page, query of login url is ignored
+func isLoginURL(u *url.URL, loginURL string) bool {
+	login, err := url.Parse(loginURL)
+	if err != nil {
+		return false
+	}
+	return u.Host == login.Host && u.Path == login.Path
+}
+
+func initClient(list config.List) (*http.Client, error) {
 	c := config.GetConfig()
+	tlsConfig, err := getUpstreamTLSConfig(list.TLS)
+	if err != nil {
+		return nil, err
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig,
 		Dial: (&net.Dialer{
 			Timeout:   c.Client.DialTimeout,
 			KeepAlive: c.Client.DialKeepalive,
@@ -34,12 +196,93 @@ func initClient() {
 		TLSHandshakeTimeout:   c.Client.TLSHandshakeTimeout,
 		ResponseHeaderTimeout: c.Client.ResponseHeaderTimeout,
 		ExpectContinueTimeout: c.Client.ExpectContinueTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+	// playlist, epg and streams of list go through its proxy, supported schemes are http, https and socks5
+	if list.Proxy != "" {
+		proxyURL, err := url.Parse(list.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
 	}
-	httpClient = &http.Client{
+	// requests to hosts which keep failing are rejected by their circuit breakers
+	client := &http.Client{
 		Timeout:   c.Client.Timeout,
-		Transport: tr,
+		Transport: &circuitTransport{next: tr},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
+	// cookies set by provider are shared by all clients of the list
+	if list.Cookies.Jar {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		client.Jar = jar
+	}
+	return client, nil
+}
+
+// getUpstreamTLSConfig builds tls config of list, by default certificates are not verified
+func getUpstreamTLSConfig(t config.UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !t.Verify,
+		ServerName:         t.ServerName,
+	}
+
+	if t.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(t.Fingerprints) > 0 {
+		pins := make([][]byte, 0, len(t.Fingerprints))
+		for _, f := range t.Fingerprints {
+			pin, err := config.ParseFingerprint(f)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, pin)
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinnedCertificate(cs, pins, t.Verify)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPinnedCertificate accepts connection if certificate matches one of pinned fingerprints.
+// Unverified connections can match only the leaf certificate, verified ones any certificate of the chain.
+func verifyPinnedCertificate(cs tls.ConnectionState, pins [][]byte, verified bool) error {
+	candidates := []*x509.Certificate{}
+	if verified {
+		for _, chain := range cs.VerifiedChains {
+			candidates = append(candidates, chain...)
+		}
+	} else if len(cs.PeerCertificates) > 0 {
+		candidates = append(candidates, cs.PeerCertificates[0])
+	}
+
+	for _, cert := range candidates {
+		sum := sha256.Sum256(cert.Raw)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("Certificate of " + cs.ServerName + " doesn`t match pinned fingerprints")
 }
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/nortoneo/iptv-proxy/internal/config"
+)
+
+// brotliLevel trades some ratio for speed, rewritten epg files can have hundreds of megabytes
+const brotliLevel = 5
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+var brotliWriters = sync.Pool{New: func() interface{} {
+	return brotli.NewWriterLevel(nil, brotliLevel)
+}}
+
+// decodeResponseBody replaces gzip encoded body of provider response with decoded one, so it can be sniffed and rewritten.
+// Partial content is left encoded because its parts can't be decoded alone. Returns if body was replaced.
+func decodeResponseBody(resp *http.Response) (bool, error) {
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "x-gzip" {
+		return false, nil
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if errors.Is(err, io.EOF) {
+		// empty body
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body = readCloser{gz, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return true, nil
+}
+
+// setResponseEncoding negotiates compression of rewritten response by request Accept-Encoding header
+// and sets response headers, returns chosen encoding or empty string when response isn't compressed
+func setResponseEncoding(h http.Header, r *http.Request) string {
+	c := config.GetConfig().Server.Compression
+	if !c.Enabled {
+		return ""
+	}
+	h.Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), c.Brotli)
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	return encoding
+}
+
+// newCompressWriter returns writer compressing rewritten body to w with encoding negotiated for request.
+// Response headers are set by it, so it has to be created before response is written and closed after body was written.
+func newCompressWriter(w io.Writer, h http.Header, r *http.Request) io.WriteCloser {
+	switch setResponseEncoding(h, r) {
+	case "br":
+		bw := brotliWriters.Get().(*brotli.Writer)
+		bw.Reset(w)
+		return pooledWriter{bw, func() error {
+			err := bw.Close()
+			brotliWriters.Put(bw)
+			return err
+		}}
+	case "gzip":
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return pooledWriter{gw, func() error {
+			err := gw.Close()
+			gzipWriters.Put(gw)
+			return err
+		}}
+	}
+	return nopWriteCloser{w}
+}
+
+// negotiateEncoding returns br or gzip accepted with highest quality, br wins ties, empty string means identity
+func negotiateEncoding(acceptEncoding string, brotliEnabled bool) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	candidates := []string{"gzip"}
+	if brotliEnabled {
+		candidates = []string{"br", "gzip"}
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range candidates {
+		q, ok := qualities[coding]
+		if !ok {
+			// wildcard applies to codings not listed explicitly
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+type pooledWriter struct {
+	io.Writer
+	close func() error
+}
+
+func (p pooledWriter) Close() error {
+	return p.close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -2,40 +2,211 @@ package proxy
 
 import (
 	"errors"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
 )
 
-var listSema = make(map[string]chan struct{})
+// listSemaphore limits simultaneous connections of a list.
+// Its size can be changed while slots are held, holders over the new size
+// keep their slots and new ones have to wait until usage drops below it.
+type listSemaphore struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	changed chan struct{}
+	// preemptible are functions stopping background holders, viewer waiting for slot stops one of them
+	preemptible map[int]func()
+	// stopping are background holders which were stopped and didn't release their slot yet
+	stopping map[int]bool
+	nextID   int
+	// waiting viewers get released slots before background work
+	waiting int
+}
+
+var listSema = make(map[string]*listSemaphore)
+var listSemaMu sync.Mutex
 var initConSemaOnce sync.Once
 
-func getListSema(listName string) chan struct{} {
-	// init semaphores once
-	initConSemaOnce.Do(func() {
-		for k, l := range config.GetConfig().Lists {
-			listSema[k] = make(chan struct{}, l.MaxConnections)
+func newListSemaphore(size int) *listSemaphore {
+	return &listSemaphore{
+		size:        size,
+		changed:     make(chan struct{}),
+		preemptible: make(map[int]func()),
+		stopping:    make(map[int]bool),
+	}
+}
+
+func (s *listSemaphore) acquire(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	waiting := false
+	defer func() {
+		if waiting {
+			s.mu.Lock()
+			s.waiting--
+			s.mu.Unlock()
+		}
+	}()
+	for {
+		s.mu.Lock()
+		if s.used < s.size {
+			s.used++
+			s.mu.Unlock()
+			return nil
+		}
+		if !waiting {
+			waiting = true
+			s.waiting++
+		}
+		changed := s.changed
+		s.preempt()
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return errors.New("Connection lock timeout")
 		}
+	}
+}
+
+// tryAcquirePreemptible takes slot only when one is free, stop is called when viewer waits for the slot
+// and holder has to release it soon. Returned id releases the slot.
+func (s *listSemaphore) tryAcquirePreemptible(stop func()) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+s.waiting >= s.size {
+		return 0, false
+	}
+	s.used++
+	s.nextID++
+	s.preemptible[s.nextID] = stop
+	return s.nextID, true
+}
+
+// preempt stops one background holder unless each waiting viewer already has one being stopped, must be called with mu held
+func (s *listSemaphore) preempt() {
+	if len(s.stopping) >= s.waiting {
+		return
+	}
+	for id, stop := range s.preemptible {
+		delete(s.preemptible, id)
+		s.stopping[id] = true
+		stop()
+		return
+	}
+}
+
+func (s *listSemaphore) release() {
+	s.mu.Lock()
+	s.used--
+	s.notify()
+	s.mu.Unlock()
+}
+
+func (s *listSemaphore) releasePreemptible(id int) {
+	s.mu.Lock()
+	delete(s.preemptible, id)
+	delete(s.stopping, id)
+	s.used--
+	s.notify()
+	s.mu.Unlock()
+}
+
+// usage returns slots in use and size of semaphore
+func (s *listSemaphore) usage() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used, s.size
+}
+
+// resize changes size of semaphore and reports if it was different
+func (s *listSemaphore) resize(size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size == size {
+		return false
+	}
+	s.size = size
+	s.notify()
+	return true
+}
+
+// notify wakes up all waiters, must be called with mu held
+func (s *listSemaphore) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func getListSema(listName string) *listSemaphore {
+	// init semaphores once, later they are synced on config reload
+	initConSemaOnce.Do(func() {
+		syncListSemas(config.GetConfig())
+		config.OnChange(func(old, new config.Config) {
+			syncListSemas(new)
+		})
 	})
 
+	listSemaMu.Lock()
+	defer listSemaMu.Unlock()
 	return listSema[listName]
 }
 
-func lockListConnection(listName string) error {
+// syncListSemas creates, resizes and removes semaphores to match lists in config.
+// Removed semaphores stay valid for connections still holding them.
+func syncListSemas(c config.Config) {
+	listSemaMu.Lock()
+	defer listSemaMu.Unlock()
+
+	for k, l := range c.Lists {
+		sema, ok := listSema[k]
+		if !ok {
+			listSema[k] = newListSemaphore(l.MaxConnections)
+			continue
+		}
+		if sema.resize(l.MaxConnections) {
+			logger.Info("Resized connection limit for list " + k + " to " + strconv.Itoa(l.MaxConnections))
+		}
+	}
+	for k := range listSema {
+		if _, ok := c.Lists[k]; !ok {
+			delete(listSema, k)
+		}
+	}
+}
+
+// lockListConnection locks connection slot of list and returns function releasing it
+func lockListConnection(listName string) (func(), error) {
 	sema := getListSema(listName)
+	if sema == nil {
+		return nil, errors.New("List " + listName + " doesn`t exist")
+	}
 	lockTimeout := config.GetConfig().Server.WaitForConnectionSlotTimeout
-	for {
-		select {
-		case sema <- struct{}{}:
-			return nil
-		case <-time.After(lockTimeout):
-			return errors.New("Connection lock timeout")
-		}
+	err := sema.acquire(lockTimeout)
+	if err != nil {
+		return nil, err
 	}
+
+	var releaseOnce sync.Once
+	return func() { releaseOnce.Do(sema.release) }, nil
 }
 
-func unlockListConnection(listName string) {
+// tryLockListConnection locks connection slot of list only when one is free, it is used by background work which must not wait for viewers.
+// When viewer waits for slot of full list, stop of one background holder is called and it has to release its slot.
+func tryLockListConnection(listName string, stop func()) (func(), bool) {
 	sema := getListSema(listName)
-	<-sema
+	if sema == nil {
+		return nil, false
+	}
+	id, ok := sema.tryAcquirePreemptible(stop)
+	if !ok {
+		return nil, false
+	}
+
+	var releaseOnce sync.Once
+	return func() { releaseOnce.Do(func() { sema.releasePreemptible(id) }) }, true
 }
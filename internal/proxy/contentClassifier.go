@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+)
+
+const (
+	sniffSize    = 1024
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// fmp4BoxTypes can start fragmented or regular mp4 file or segment
+var fmp4BoxTypes = [...]string{"ftyp", "styp", "moof", "moov", "sidx", "emsg", "prft"}
+
+var imageSignatures = [...][]byte{
+	{0xFF, 0xD8, 0xFF},          // jpeg
+	[]byte("\x89PNG\r\n\x1a\n"), // png
+	[]byte("GIF8"),              // gif
+}
+
+// classifyResponse decides if response body should be parsed to convert urls or streamed unchanged.
+// Per list rules win, then body is sniffed by magic bytes, content type and extension are used only when body is empty.
+// Returns also what the decision was based on and replaces resp.Body with reader containing sniffed bytes.
+func classifyResponse(resp *http.Response, contentType, pathExtension, listName string) (bool, string) {
+	if list, err := config.GetListFromConfig(listName); err == nil {
+		if matchContentRule(list.Content.Parse, contentType, pathExtension) {
+			return true, "rule:" + contentType + pathExtension
+		}
+		if matchContentRule(list.Content.Stream, contentType, pathExtension) {
+			return false, "rule:" + contentType + pathExtension
+		}
+	}
+
+	br := bufio.NewReaderSize(resp.Body, sniffSize)
+	resp.Body = readCloser{br, resp.Body}
+	head, _ := br.Peek(sniffSize)
+	if len(head) == 0 {
+		return shouldParseResponse(contentType, pathExtension)
+	}
+
+	kind, parse := sniffContent(head)
+	return parse, kind
+}
+
+// sniffContent recognizes media and text formats by first bytes of body
+func sniffContent(head []byte) (string, bool) {
+	switch {
+	case isMPEGTS(head):
+		return "mpegts", false
+	case isFMP4(head):
+		return "mp4", false
+	case bytes.HasPrefix(head, []byte("ID3")):
+		// packed audio segments start with ID3 timestamp tag
+		return "id3", false
+	case isADTS(head):
+		return "adts", false
+	}
+	for _, sig := range imageSignatures {
+		if bytes.HasPrefix(head, sig) {
+			return "image", false
+		}
+	}
+
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("#EXTM3U")):
+		return "m3u", true
+	case bytes.HasPrefix(text, []byte("<?xml")), bytes.HasPrefix(text, []byte("<tv")), bytes.HasPrefix(text, []byte("<MPD")):
+		return "xml", true
+	case isText(head):
+		return "text", true
+	}
+	return "binary", false
+}
+
+// isMPEGTS checks sync byte at start of three consecutive packets
+func isMPEGTS(head []byte) bool {
+	if len(head) <= 2*tsPacketSize {
+		return false
+	}
+	return head[0] == tsSyncByte && head[tsPacketSize] == tsSyncByte && head[2*tsPacketSize] == tsSyncByte
+}
+
+func isFMP4(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	boxType := string(head[4:8])
+	for _, t := range fmp4BoxTypes {
+		if boxType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// isADTS checks ADTS frame header: 12 bit sync word and layer 0
+func isADTS(head []byte) bool {
+	return len(head) >= 7 && head[0] == 0xFF && head[1]&0xF6 == 0xF0
+}
+
+// isText reports if data is valid utf8 without control characters except whitespace
+func isText(head []byte) bool {
+	valid := utf8.Valid(head)
+	// last rune may be cut by sniff size
+	for i := 1; !valid && i < utf8.UTFMax && i < len(head); i++ {
+		valid = utf8.Valid(head[:len(head)-i])
+	}
+	if !valid {
+		return false
+	}
+	for _, b := range head {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchContentRule matches extension rules starting with dot and content type rules, * at the end matches any suffix
+func matchContentRule(rules []string, contentType, pathExtension string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, ".") {
+			if strings.EqualFold(rule, pathExtension) {
+				return true
+			}
+			continue
+		}
+		if strings.HasSuffix(rule, "*") {
+			if mediaType != "" && strings.HasPrefix(strings.ToLower(mediaType), strings.ToLower(rule[:len(rule)-1])) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(rule, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
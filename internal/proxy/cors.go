@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+
+	"github.com/gorilla/mux"
+)
+
+// corsMiddleware adds CORS headers configured for list of the request and answers preflight requests
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		list, err := config.GetListFromConfig(requestListName(r))
+		if err != nil || !isOriginAllowed(origin, list.CORS) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cors := list.CORS
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allowsAnyOrigin(cors) && !cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		reqMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || reqMethod == "" {
+			if len(cors.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// preflight request
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !matchHeader(reqMethod, cors.AllowedMethods) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			allowed := []string{}
+			for _, name := range strings.Split(reqHeaders, ",") {
+				name = strings.TrimSpace(name)
+				if matchHeader(name, cors.AllowedHeaders) {
+					allowed = append(allowed, name)
+				}
+			}
+			h.Set("Access-Control-Allow-Headers", strings.Join(allowed, ", "))
+		}
+		if cors.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func allowsAnyOrigin(cors config.CORS) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func isOriginAllowed(origin string, cors config.CORS) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCORSEnabled reports if list sets its own CORS headers instead of provider ones
+func isCORSEnabled(listName string) bool {
+	list, err := config.GetListFromConfig(listName)
+	return err == nil && len(list.CORS.AllowedOrigins) > 0
+}
+
+// requestListName returns name of list request belongs to, from route variables or proxy url param
+func requestListName(r *http.Request) string {
+	vars := mux.Vars(r)
+	if name := vars["name"]; name != "" {
+		return name
+	}
+	if name := vars["list"]; name != "" {
+		return name
+	}
+	return r.URL.Query().Get(urlconvert.GetParamList())
+}
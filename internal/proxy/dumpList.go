@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+)
+
+const maxDumpRedirects = 10
+
+// DumpList fetches playlist of list and writes it to w rewritten the same way clients get it
+func DumpList(listName string, w io.Writer) error {
+	listURLString, err := config.GetListURL(listName)
+	if err != nil {
+		return err
+	}
+
+	client, err := GetListClient(listName)
+	if err != nil {
+		return err
+	}
+	resp, err := getFollowingRedirects(context.Background(), client, listURLString, listName)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode) + " of list " + listName)
+	}
+
+	if _, err := decodeResponseBody(resp); err != nil {
+		return err
+	}
+
+	encURL, err := urlconvert.EncodeTarget(resp.Request.URL.String(), listName)
+	if err != nil {
+		return err
+	}
+	return rewriteBody(context.Background(), resp.Body, w, listName, encURL)
+}
+
+// getFollowingRedirects does GET request following redirects which proxy client doesn't do on its own
+func getFollowingRedirects(ctx context.Context, client *http.Client, urlString, listName string) (*http.Response, error) {
+	for i := 0; i < maxDumpRedirects; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", urlString, nil)
+		if err != nil {
+			return nil, err
+		}
+		setUpstreamHeaders(req, nil, listName)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		location := resp.Header.Get("location")
+		if resp.StatusCode < 300 || resp.StatusCode > 399 || location == "" {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		next, err := req.URL.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		urlString = next.String()
+	}
+
+	return nil, errors.New("Too many redirects for " + urlString)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+)
+
+// diskSegmentStore keeps segments of last maxDuration in files of dir, oldest ones are removed when maxSize is exceeded
+type diskSegmentStore struct {
+	mu               sync.Mutex
+	dir              string
+	maxDuration      time.Duration
+	maxSize          int64
+	infos            []storedSegment
+	duration         time.Duration
+	size             int64
+	nextSeq          int
+	discontinuitySeq int
+}
+
+// newDiskSegmentStore creates empty store in dir, files left in dir by previous run are removed
+func newDiskSegmentStore(dir string, maxDuration time.Duration, maxSize int64) (*diskSegmentStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &diskSegmentStore{dir: dir, maxDuration: maxDuration, maxSize: maxSize}, nil
+}
+
+func (s *diskSegmentStore) add(seg mpegts.Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.WriteFile(s.path(s.nextSeq), seg.Data, 0o644); err != nil {
+		return err
+	}
+	s.infos = append(s.infos, storedSegment{
+		seq:           s.nextSeq,
+		duration:      seg.Duration,
+		discontinuity: seg.Discontinuity,
+		size:          int64(len(seg.Data)),
+		created:       time.Now(),
+	})
+	s.nextSeq++
+	s.duration += seg.Duration
+	s.size += int64(len(seg.Data))
+
+	// the newest segment is kept even when it alone is over limits
+	for len(s.infos) > 1 && (s.duration > s.maxDuration || s.size > s.maxSize) {
+		oldest := s.infos[0]
+		if err := os.Remove(s.path(oldest.seq)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Unable to remove buffered segment: " + err.Error())
+		}
+		if oldest.discontinuity {
+			s.discontinuitySeq++
+		}
+		s.duration -= oldest.duration
+		s.size -= oldest.size
+		s.infos = s.infos[1:]
+	}
+	return nil
+}
+
+func (s *diskSegmentStore) segments() ([]storedSegment, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]storedSegment(nil), s.infos...), s.discontinuitySeq
+}
+
+func (s *diskSegmentStore) open(seq int) (io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.infos) == 0 || seq < s.infos[0].seq || seq >= s.nextSeq {
+		return nil, errSegmentNotFound
+	}
+	// opened file stays readable even when segment is removed from store meanwhile
+	return os.Open(s.path(seq))
+}
+
+func (s *diskSegmentStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infos = nil
+	return os.RemoveAll(s.dir)
+}
+
+func (s *diskSegmentStore) path(seq int) string {
+	return filepath.Join(s.dir, strconv.Itoa(seq)+".ts")
+}
+
+// safeFileName returns name usable as single path element, characters other than letters, digits, dash, dot and underscore are replaced
+func safeFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	safe = strings.TrimLeft(safe, ".")
+	if safe == "" {
+		return "_"
+	}
+	return safe
+}
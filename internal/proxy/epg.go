@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errProgrammeNotFound = errors.New("Programme not found")
+
+// programme is XMLTV programme of channel
+type programme struct {
+	ID    string    `json:"id"`
+	Title string    `json:"title"`
+	Start time.Time `json:"start"`
+	Stop  time.Time `json:"stop"`
+}
+
+type xmltvProgramme struct {
+	Channel string   `xml:"channel,attr"`
+	Start   string   `xml:"start,attr"`
+	Stop    string   `xml:"stop,attr"`
+	Titles  []string `xml:"title"`
+}
+
+// xmltvTimeFormats are formats of XMLTV start and stop attributes, time without zone is UTC
+var xmltvTimeFormats = [...]string{"20060102150405 -0700", "20060102150405", "200601021504 -0700", "200601021504"}
+
+// programmeID identifies programme by XMLTV channel id and start time
+func programmeID(epgChannel string, start time.Time) string {
+	return epgChannel + "@" + start.UTC().Format("20060102150405")
+}
+
+// getProgrammes returns programmes of channel from list epg which end after since, channel is matched by its tvg-id
+func getProgrammes(ctx context.Context, listName string, ch channel, since time.Time) ([]programme, error) {
+	epgChannel := ch.Attrs["tvg-id"]
+	if epgChannel == "" {
+		return nil, errors.New("Channel " + ch.ID + " has no tvg-id")
+	}
+	epgURL, err := getEPGURL(ctx, listName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := GetListClient(listName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getFollowingRedirects(ctx, client, epgURL, listName)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode) + " of epg " + epgURL)
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return nil, err
+	}
+
+	// guides are often served as .xml.gz files without content encoding
+	var body io.Reader = bufio.NewReader(resp.Body)
+	if magic, _ := body.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1F && magic[1] == 0x8B {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return parseProgrammes(body, epgChannel, since)
+}
+
+// parseProgrammes reads XMLTV guide in one pass and returns programmes of channel ending after since
+func parseProgrammes(body io.Reader, epgChannel string, since time.Time) ([]programme, error) {
+	d := xml.NewDecoder(body)
+	// titles of guides in other charsets than utf-8 may be garbled, but the guide is still read
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	programmes := []programme{}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return programmes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "programme" {
+			continue
+		}
+		if !hasAttr(start, "channel", epgChannel) {
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var p xmltvProgramme
+		if err := d.DecodeElement(&p, &start); err != nil {
+			return nil, err
+		}
+		startTime, err1 := parseXMLTVTime(p.Start)
+		stopTime, err2 := parseXMLTVTime(p.Stop)
+		if err1 != nil || err2 != nil || !stopTime.After(since) {
+			continue
+		}
+		title := ""
+		if len(p.Titles) > 0 {
+			title = strings.TrimSpace(p.Titles[0])
+		}
+		programmes = append(programmes, programme{ID: programmeID(epgChannel, startTime), Title: title, Start: startTime, Stop: stopTime})
+	}
+}
+
+// findProgramme returns programme of channel by its id
+func findProgramme(ctx context.Context, listName string, ch channel, id string) (programme, error) {
+	programmes, err := getProgrammes(ctx, listName, ch, time.Now())
+	if err != nil {
+		return programme{}, err
+	}
+	for _, p := range programmes {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return programme{}, errProgrammeNotFound
+}
+
+func hasAttr(e xml.StartElement, name, value string) bool {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value == value
+		}
+	}
+	return false
+}
+
+func parseXMLTVTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, format := range xmltvTimeFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid XMLTV time " + s)
+}
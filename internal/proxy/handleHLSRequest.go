@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+
+	"github.com/gorilla/mux"
+)
+
+// repackageReadyTimeout is added to segment duration when waiting for first segment of started channel
+const repackageReadyTimeout = 15 * time.Second
+
+// handleHLSPlaylist serves live playlist of MPEG-TS channel repackaged to HLS
+func handleHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorizeList(w, vars["list"], vars["token"]) {
+		return
+	}
+	rp, ok := startRepackager(w, r, vars["list"], vars["channel"])
+	if !ok {
+		return
+	}
+
+	c := config.GetConfig().Server.Repackage
+	segments, discontinuitySeq := rp.store.segments()
+	if len(segments) > c.PlaylistSize {
+		for _, seg := range segments[:len(segments)-c.PlaylistSize] {
+			if seg.discontinuity {
+				discontinuitySeq++
+			}
+		}
+		segments = segments[len(segments)-c.PlaylistSize:]
+	}
+	writeMediaPlaylist(w, segments, discontinuitySeq, rp.channel.ID, vars["token"])
+}
+
+// handleDVRPlaylist serves playlist of channel disk buffer, it lists all buffered segments so players can rewind.
+// It is live sliding window without #EXT-X-PLAYLIST-TYPE:EVENT, event playlists must keep all segments
+// but the oldest ones leave the buffer after server.dvr.duration.
+func handleDVRPlaylist(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorizeList(w, vars["list"], vars["token"]) {
+		return
+	}
+	if config.GetConfig().Server.DVR.Dir == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rp, ok := startRepackager(w, r, vars["list"], vars["channel"])
+	if !ok {
+		return
+	}
+
+	store, err := rp.dvrStore()
+	if err != nil {
+		logger.Error("Unable to buffer " + rp.key + ": " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	segments, discontinuitySeq := store.segments()
+	writeMediaPlaylist(w, segments, discontinuitySeq, rp.channel.ID, vars["token"])
+}
+
+// startRepackager returns repackager of channel once it has first segment, error response is written when it fails
+func startRepackager(w http.ResponseWriter, r *http.Request, listName, channelID string) (*repackager, bool) {
+	ch, err := getChannel(r.Context(), listName, channelID)
+	if errors.Is(err, errChannelNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		logger.Error("Unable to get channels of list " + listName + ": " + err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return nil, false
+	}
+
+	rp := getRepackager(listName, ch)
+	timeout := config.GetConfig().Server.Repackage.SegmentDuration*2 + repackageReadyTimeout
+	if err := rp.waitReady(r.Context(), timeout); err != nil {
+		logger.Warn("Channel " + rp.key + " is not available: " + err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return rp, true
+}
+
+// writeMediaPlaylist writes playlist of segments, their urls are relative to playlist url
+func writeMediaPlaylist(w http.ResponseWriter, segments []storedSegment, discontinuitySeq int, channelID, token string) {
+	segmentURL := func(seq int) string {
+		return url.PathEscape(channelID) + "/" + strconv.Itoa(seq) + ".ts?token=" + url.QueryEscape(token)
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	segmentDuration := config.GetConfig().Server.Repackage.SegmentDuration
+	w.Write([]byte(liveMediaPlaylist(segments, discontinuitySeq, segmentDuration, segmentURL)))
+}
+
+// handleHLSSegment serves segment of repackaged channel
+func handleHLSSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeList(w, listName, vars["token"]) {
+		return
+	}
+
+	rp, ok := findRepackager(listName, vars["channel"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serveStoredSegment(w, r, rp.store, vars["seq"])
+}
+
+// handleDVRSegment serves segment of channel disk buffer
+func handleDVRSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorizeList(w, vars["list"], vars["token"]) {
+		return
+	}
+
+	rp, ok := findRepackager(vars["list"], vars["channel"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rp.mu.Lock()
+	store := rp.dvr
+	rp.mu.Unlock()
+	if store == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serveStoredSegment(w, r, store, vars["seq"])
+}
+
+// serveStoredSegment serves segment of store with range support
+func serveStoredSegment(w http.ResponseWriter, r *http.Request, store segmentStore, seqParam string) {
+	seq, err := strconv.Atoi(seqParam)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := store.open(seq)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	http.ServeContent(w, r, "", time.Time{}, body)
+}
+
+// liveMediaPlaylist writes HLS media playlist of segments, segmentURL returns url of segment by its sequence number.
+// Target duration must not change while window slides, so it is the longest segment segmenter can cut.
+func liveMediaPlaylist(segments []storedSegment, discontinuitySeq int, segmentDuration time.Duration, segmentURL func(int) string) string {
+	targetDuration := mpegts.MaxDuration(segmentDuration)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration.Seconds())))
+	if len(segments) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].seq)
+	}
+	if discontinuitySeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq)
+	}
+	for _, seg := range segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.duration.Seconds())
+		b.WriteString(segmentURL(seg.seq) + "\n")
+	}
+	return b.String()
+}
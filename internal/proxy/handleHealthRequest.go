@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+
+	"github.com/gorilla/mux"
+)
+
+// channelHealth is status of list channel by its probes
+type channelHealth struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Group   string        `json:"group,omitempty"`
+	Status  string        `json:"status"`
+	History []probeResult `json:"history"`
+}
+
+// handleHealthRequest returns probe status and history of list channels, status parameter filters them by status
+func handleHealthRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeList(w, listName, vars["token"]) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if list, err := config.GetListFromConfig(listName); err != nil || !list.Probe.Enabled {
+		writeJSONError(w, http.StatusNotFound, "Probes of list "+listName+" are disabled")
+		return
+	}
+
+	channels, err := getChannels(r.Context(), listName)
+	if err != nil {
+		logger.Error("Unable to get channels of list " + listName + ": " + err.Error())
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	filter := r.URL.Query().Get("status")
+	health := []channelHealth{}
+	for _, ch := range channels {
+		results := probes.results(listName, ch.URL)
+		status := channelStatus(results)
+		if filter != "" && filter != status {
+			continue
+		}
+		health = append(health, channelHealth{ID: ch.ID, Name: ch.Name, Group: ch.Group, Status: status, History: results})
+	}
+	writeJSON(w, http.StatusOK, health)
+}
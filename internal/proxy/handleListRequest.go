@@ -1,10 +1,10 @@
 package proxy
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
 	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
 
 	"github.com/gorilla/mux"
@@ -15,38 +15,29 @@ func handleListRequest(w http.ResponseWriter, r *http.Request) {
 	reqListName := vars["name"]
 	reqToken := vars["token"]
 	listURLString, err := config.GetListURL(reqListName)
-	log.Println("Using list: " + listURLString)
+	logger.Debug("Using list: " + listURLString)
 	if err != nil {
-		log.Println(err.Error())
+		logger.Warn(err.Error())
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	token, err := config.GetListToken(reqListName)
-	if err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	if token != reqToken {
-		log.Println("Wrong token for list " + reqListName)
-		w.WriteHeader(http.StatusUnauthorized)
+	if !authorizeList(w, reqListName, reqToken) {
 		return
 	}
 
-	err = lockListConnection(reqListName)
+	releaseConnection, err := lockListConnection(reqListName)
 	if err != nil {
-		log.Println("Too many connections for list " + reqListName)
+		logger.Warn("Too many connections for list " + reqListName)
 		w.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
-	defer unlockListConnection(reqListName)
+	defer releaseConnection()
 
 	proxiedURLString, err := urlconvert.ConvertURLtoProxyURL(listURLString, config.GetConfig().App.URL, reqListName)
-	log.Println("Proxy list: " + proxiedURLString)
+	logger.Debug("Proxy list: " + proxiedURLString)
 	if err != nil {
-		log.Println(err.Error())
+		logger.Warn(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -54,3 +45,20 @@ func handleListRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("location", proxiedURLString)
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
+
+// authorizeList checks token of list request, on failure it writes error status and returns false
+func authorizeList(w http.ResponseWriter, listName, reqToken string) bool {
+	token, err := config.GetListToken(listName)
+	if err != nil {
+		logger.Warn(err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+
+	if token != reqToken {
+		logger.Warn("Wrong token for list " + listName)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+var metricLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// handleMetricsRequest serves state of upstream circuit breakers and connection slots of lists in Prometheus text format
+func handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	c := config.GetConfig().Server.Metrics
+	if !c.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if c.Token != "" && r.URL.Query().Get("token") != c.Token {
+		logger.Warn("Wrong token for metrics")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b strings.Builder
+	circuits := circuitSnapshots()
+	b.WriteString("# HELP iptvproxy_upstream_circuit_state State of circuit breaker of upstream host, 0 closed, 1 open, 2 half-open.\n")
+	b.WriteString("# TYPE iptvproxy_upstream_circuit_state gauge\n")
+	for _, s := range circuits {
+		fmt.Fprintf(&b, "iptvproxy_upstream_circuit_state{host=\"%s\"} %d\n", metricLabelReplacer.Replace(s.host), s.state)
+	}
+	b.WriteString("# HELP iptvproxy_upstream_failures_total Failed connections to upstream host.\n")
+	b.WriteString("# TYPE iptvproxy_upstream_failures_total counter\n")
+	for _, s := range circuits {
+		fmt.Fprintf(&b, "iptvproxy_upstream_failures_total{host=\"%s\"} %d\n", metricLabelReplacer.Replace(s.host), s.totalFailures)
+	}
+	b.WriteString("# HELP iptvproxy_upstream_rejected_total Requests to upstream host rejected by open circuit.\n")
+	b.WriteString("# TYPE iptvproxy_upstream_rejected_total counter\n")
+	for _, s := range circuits {
+		fmt.Fprintf(&b, "iptvproxy_upstream_rejected_total{host=\"%s\"} %d\n", metricLabelReplacer.Replace(s.host), s.rejected)
+	}
+
+	lists := make([]string, 0, len(config.GetConfig().Lists))
+	for name := range config.GetConfig().Lists {
+		lists = append(lists, name)
+	}
+	sort.Strings(lists)
+	var used, size strings.Builder
+	for _, name := range lists {
+		sema := getListSema(name)
+		if sema == nil {
+			continue
+		}
+		inUse, slots := sema.usage()
+		fmt.Fprintf(&used, "iptvproxy_list_connections{list=\"%s\"} %d\n", metricLabelReplacer.Replace(name), inUse)
+		fmt.Fprintf(&size, "iptvproxy_list_max_connections{list=\"%s\"} %d\n", metricLabelReplacer.Replace(name), slots)
+	}
+	b.WriteString("# HELP iptvproxy_list_connections Connection slots of list in use.\n")
+	b.WriteString("# TYPE iptvproxy_list_connections gauge\n")
+	b.WriteString(used.String())
+	b.WriteString("# HELP iptvproxy_list_max_connections Connection slots of list.\n")
+	b.WriteString("# TYPE iptvproxy_list_max_connections gauge\n")
+	b.WriteString(size.String())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	w.Write([]byte(b.String()))
+}
@@ -1,27 +1,43 @@
 package proxy
 
 import (
-	"bufio"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
-	"regexp"
 	"strings"
 
 	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
 	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
 )
 
-const (
-	urlRegex = `\bhttps?://[^,\s()<>]+(?:\([\w\d]+\)|([^,[:punct:]\s]|/))`
-)
+var rangeRequestHeaders = [...]string{"Range", "If-Range"}
+
+// dropRangeHeaders removes byte range of request passed through by list headers policy,
+// ranges of rewritten playlists wouldn't match, so they are requested only for other files
+func dropRangeHeaders(req *http.Request) {
+	for _, h := range rangeRequestHeaders {
+		req.Header.Del(h)
+	}
+}
+
+var playlistExtensions = [...]string{"m3u", "m3u8"}
+
+func isPlaylistExtension(pathExtension string) bool {
+	for _, ext := range playlistExtensions {
+		if "."+ext == pathExtension {
+			return true
+		}
+	}
+	return false
+}
 
 func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
 	realURLString, listName, err := urlconvert.ConvertProxyRequestToURL(r)
 	if err != nil {
-		log.Printf("Failed to convert path (%s) %s\n", err, r.URL.String())
+		logger.Warnf("Failed to convert path (%s) %s", err, r.URL.String())
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -32,6 +48,13 @@ func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
 		pathExtension = filepath.Ext(realURL.Path)
 	}
 
+	if serveCachedSegment(w, r, realURLString, listName) {
+		return
+	}
+	if serveSharedManifest(w, r, realURLString, listName, pathExtension) {
+		return
+	}
+
 	isImageExtension := false
 	imageFileExtension := [...]string{"jpg", "jpeg", "gif", "png"}
 	for _, ext := range imageFileExtension {
@@ -41,182 +64,194 @@ func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// slot is not taken for host which is down
+	if realURL != nil {
+		if retryAfter, open := circuitRetryAfter(realURL.Host); open {
+			logger.Debug("Circuit of upstream host " + realURL.Host + " is open, rejecting request of list " + listName)
+			writeCircuitOpen(w, retryAfter)
+			return
+		}
+	}
+
 	if isImageExtension == false {
-		err = lockListConnection(listName)
+		releaseConnection, err := acquireListConnection(r, listName, realURLString)
 		if err != nil {
-			log.Println("Too many connections for list " + listName)
+			logger.Warn("Too many connections for list " + listName)
 			w.WriteHeader(http.StatusTooManyRequests)
 			return
 		}
-		defer unlockListConnection(listName)
+		defer releaseConnection()
 	}
 
-	req, err := http.NewRequest("GET", realURLString, nil)
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, realURLString, nil)
 	if err != nil {
-		log.Println(err.Error())
+		logger.Error(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	req.Header.Set("User-Agent", r.Header.Get("user-agent"))
-	resp, err := GetClient().Do(req)
+	setUpstreamHeaders(req, r, listName)
+	if isPlaylistExtension(pathExtension) {
+		dropRangeHeaders(req)
+	}
+	client, err := GetListClient(listName)
 	if err != nil {
-		log.Println(err.Error())
+		logger.Error(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var openErr *circuitOpenError
+		if errors.As(err, &openErr) {
+			logger.Debug(err.Error())
+			writeCircuitOpen(w, openErr.retryAfter)
+			return
+		}
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
 	defer resp.Body.Close()
 
 	contentType := resp.Header.Get("content-type")
-	if contentType != "" {
-		w.Header().Set("content-type", contentType)
+	parse, detectedBy := false, ""
+	if r.Method == http.MethodHead {
+		parse, detectedBy = shouldParseResponse(contentType, pathExtension)
+	} else {
+		if _, err := decodeResponseBody(resp); err != nil {
+			logger.Error("Unable to decode response of " + realURLString + ": " + err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		parse, detectedBy = classifyResponse(resp, contentType, pathExtension, listName)
 	}
+	copyResponseHeaders(w.Header(), resp.Header, listName, parse)
 
 	location := resp.Header.Get("location")
 	if location != "" {
-		proxyLocation, err := urlconvert.ConvertURLtoProxyURL(location, config.GetConfig().App.URL, listName)
+		// relative location is resolved against upstream url before converting
+		if locationURL, err := req.URL.Parse(location); err == nil {
+			location = locationURL.String()
+		}
+		proxyLocation, err := convertLocation(r, location, realURLString, listName)
 		if err != nil {
-			log.Println("Unable to convert location header: " + location)
+			logger.Warn("Unable to convert location header: " + location)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		log.Println("Redirecting to: " + proxyLocation + " original target: " + location)
+		logger.Debug("Redirecting to: " + proxyLocation + " original target: " + location)
 		w.Header().Set("location", proxyLocation)
 	}
 
 	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
-	w.WriteHeader(resp.StatusCode)
 
-	//	handling body - decide by content type if we should stream the response or parse it to convert potential urls
+	if r.Method == http.MethodHead {
+		if parse {
+			setResponseEncoding(w.Header(), r)
+		}
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	if parse {
+		logger.Info("Parsing: [" + detectedBy + "] " + realURLString)
+		// rewritten body has different length, it is buffered to set correct Content-Length
+		bw := newLengthBufferWriter(w, resp.StatusCode)
+		cw := newCompressWriter(bw, w.Header(), r)
+		parseHTTPClientResponceBody(resp, cw, r)
+		if err := cw.Close(); err != nil {
+			logger.Debug("Unable to compress response: " + err.Error())
+		}
+		if err := bw.Close(); err != nil {
+			logger.Debug("Unable to write response: " + err.Error())
+		}
+	} else {
+		w.WriteHeader(resp.StatusCode)
+		logger.Info("Streaming: [" + detectedBy + "] " + realURLString)
+		streamHTTPClientResponceBody(resp, w, r)
+	}
+	logger.Info("Completed: [" + detectedBy + "] " + realURLString)
+}
+
+// shouldParseResponse decides by content type and extension if we should parse the response to convert potential urls
+// or stream it, returns also content type or extension used for decision. It is used only when body can't be sniffed.
+func shouldParseResponse(contentType, pathExtension string) (bool, string) {
 	parsableContentType := [...]string{"text/", "url"}
 	for _, parsableCT := range parsableContentType {
 		if strings.Contains(contentType, parsableCT) {
-			log.Println("Parsing: [" + contentType + "] " + realURLString)
-			parseHTTPClientResponceBody(resp, w, r)
-			log.Println("Completed:  [" + contentType + "] " + realURLString)
-			return
+			return true, contentType
 		}
 	}
 
 	streamableContentType := [...]string{"video/", "image/"}
 	for _, streamableCT := range streamableContentType {
 		if strings.Contains(contentType, streamableCT) {
-			log.Println("Streaming:  [" + contentType + "] " + realURLString)
-			streamHTTPClientResponceBody(resp, w, r)
-			log.Println("Completed:  [" + contentType + "] " + realURLString)
-			return
+			return false, contentType
 		}
 	}
 
 	streamableFileExtension := [...]string{"ts", "h264", "mkv", "mpg", "mpeg", "mp2", "mpe", "mpv", "vob", "mp4", "m4p", "m4v", "avi", "mp3", "aac", "mpa", "ac3", "webm", "ogg", "mov", "zip", "gz"}
 	for _, ext := range streamableFileExtension {
 		if "."+ext == pathExtension {
-			log.Println("Streaming: [" + pathExtension + "] " + realURLString)
-			streamHTTPClientResponceBody(resp, w, r)
-			log.Println("Completed: [" + pathExtension + "] " + realURLString)
-			return
+			return false, pathExtension
 		}
 	}
 
-	log.Println("Parsing: [" + pathExtension + "] " + realURLString)
-	parseHTTPClientResponceBody(resp, w, r)
-	log.Println("Completed: [" + pathExtension + "] " + realURLString)
+	return true, pathExtension
 }
 
-func parseHTTPClientResponceBody(resp *http.Response, w http.ResponseWriter, r *http.Request) {
+func parseHTTPClientResponceBody(resp *http.Response, w io.Writer, r *http.Request) {
 	listName := r.URL.Query().Get(urlconvert.GetParamList())
 	encURL := r.URL.Query().Get(urlconvert.GetParamEncTarget())
-	isEXTM3UFile := false
-	ctx := r.Context()
-
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if isEXTM3UFile == false {
-			isEXTM3UFile = strings.Contains(line, "#EXTM3U")
-		}
-
-		//add url query params to paths if its EXTM3U
-		if isEXTM3UFile {
-			if len(line) > 0 && string(line[0]) != "#" {
-				convLine, _ := urlconvert.ConvertPathToProxyPath(line, listName, encURL)
-				if convLine != "" {
-					line = convLine
-				}
-			} else {
-				urire := regexp.MustCompile(`(URI|uri)=".*"`)
-				urisToReplace := urire.FindAllString(line, -1)
-				for _, uriToReplace := range urisToReplace {
-					pathToReplace := uriToReplace[5 : len(uriToReplace)-1]
-					proxiedPath, err := urlconvert.ConvertPathToProxyPath(pathToReplace, listName, encURL)
-					if err != nil {
-						log.Println("Unable to convert uri path: " + pathToReplace)
-					}
-					line = strings.ReplaceAll(line, pathToReplace, proxiedPath)
-				}
-			}
-		}
-
-		//converting any urls to proxy urls
-		re := regexp.MustCompile(urlRegex)
-		urlsToReplace := re.FindAllString(line, -1)
-		for _, urlToReplace := range urlsToReplace {
-			proxiedURL, err := urlconvert.ConvertURLtoProxyURL(urlToReplace, config.GetConfig().App.URL, listName)
-			if err != nil {
-				log.Println("Unable to convert url: " + urlToReplace)
-			}
-			line = strings.ReplaceAll(line, urlToReplace, proxiedURL)
-		}
-
-		select {
-		case <-ctx.Done():
-			log.Println("Connection closed.")
-			return
-		default:
-			w.Write([]byte(line + "\n"))
-		}
+	p, err := newPlaylistRewriter(listName, encURL)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	p.baseURL = resp.Request.URL
+	p.variants = clientVariantFilter(r, listName)
+	p.stream = streamLineage(r, resp.Request.URL.String())
+	if err := p.rewrite(r.Context(), resp.Body, w); err != nil {
+		logger.Debug("Rewrite interrupted: " + err.Error())
 	}
 }
 
 func streamHTTPClientResponceBody(resp *http.Response, w http.ResponseWriter, r *http.Request) {
-	binaryDataChecked := false
 	buf := make([]byte, 5*1024) //the chunk size
 	ctx := r.Context()
-	reader := bufio.NewReader(resp.Body)
 	for {
-		n, err := reader.Read(buf)
-		if err != nil && err != io.EOF {
-			log.Println(err)
-			panic(err)
-		}
-		if n == 0 {
-			break
-		}
-
-		//test first chunk if we are really dealing with binary data
-		if binaryDataChecked == false {
-			if detectNullChar(buf[:n]) == false {
-				log.Println("Wont stream non binary data")
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				logger.Debug("Connection closed.")
 				return
+			default:
+				w.Write(buf[:n])
 			}
-			binaryDataChecked = true
 		}
-
-		select {
-		case <-ctx.Done():
-			log.Println("Connection closed.")
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logger.Warn("Stream interrupted: " + err.Error())
 			return
-		default:
-			w.Write(buf[:n])
 		}
-
 	}
 }
 
-func detectNullChar(buf []byte) bool {
-	for _, b := range buf {
-		if b == 0 {
-			return true
-		}
+// convertLocation converts redirect location to proxy url, redirected HLS requests keep lineage of their stream
+func convertLocation(r *http.Request, location, realURL, listName string) (string, error) {
+	c, err := urlconvert.NewURLConverter(config.GetConfig().App.URL, listName)
+	if err != nil {
+		return "", err
 	}
-	return false
+	if isHLSSessionRequest(r, realURL) {
+		c.SetStream(streamLineage(r, realURL), nil)
+	}
+	return c.Convert(location)
 }
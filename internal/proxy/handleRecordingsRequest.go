@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRecordingRequestSize limits body of recording create request
+const maxRecordingRequestSize = 64 * 1024
+
+// recordingRequest is body of recording create request, recording is made by programme id or by start and stop
+type recordingRequest struct {
+	Channel   string    `json:"channel"`
+	Programme string    `json:"programme"`
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop"`
+}
+
+// handleRecordingsRequest lists recordings of list or creates new one
+func handleRecordingsRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeRecordings(w, listName, vars["token"]) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, recordings.list(listName))
+	case http.MethodPost:
+		createRecording(w, r, listName)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func createRecording(w http.ResponseWriter, r *http.Request, listName string) {
+	var req recordingRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRecordingRequestSize)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+	if req.Channel == "" {
+		writeJSONError(w, http.StatusBadRequest, "Channel is required")
+		return
+	}
+	ch, err := getChannel(r.Context(), listName, req.Channel)
+	if errors.Is(err, errChannelNotFound) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to get channels of list " + listName + ": " + err.Error())
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	var p programme
+	if req.Programme != "" {
+		if p, err = findProgramme(r.Context(), listName, ch, req.Programme); err != nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, errProgrammeNotFound) {
+				status = http.StatusBadRequest
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		req.Start, req.Stop = p.Start, p.Stop
+	}
+
+	rec, err := recordings.create(listName, ch, req.Start, req.Stop)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if p.ID != "" {
+		recordings.setProgramme(rec.ID, p)
+		rec.Programme, rec.Title = p.ID, p.Title
+	}
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+// handleRecordingRequest returns or removes recording
+func handleRecordingRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeRecordings(w, listName, vars["token"]) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rec, err := recordings.get(listName, vars["id"])
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	case http.MethodDelete:
+		if err := recordings.remove(listName, vars["id"]); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleProgrammesRequest returns programmes of channel which haven't ended yet, their ids can be used to create recordings
+func handleProgrammesRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeList(w, listName, vars["token"]) {
+		return
+	}
+
+	ch, err := getChannel(r.Context(), listName, vars["channel"])
+	if errors.Is(err, errChannelNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err == nil {
+		var programmes []programme
+		if programmes, err = getProgrammes(r.Context(), listName, ch, time.Now()); err == nil {
+			writeJSON(w, http.StatusOK, programmes)
+			return
+		}
+	}
+	logger.Warn("Unable to get programmes of " + listName + "|" + vars["channel"] + ": " + err.Error())
+	writeJSONError(w, http.StatusBadGateway, err.Error())
+}
+
+// handleRecordingPlaylist serves recording as HLS playlist of byte ranges, unfinished recording is served as event playlist
+func handleRecordingPlaylist(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeRecordings(w, listName, vars["token"]) {
+		return
+	}
+	rec, err := recordings.segments(listName, vars["id"])
+	if err != nil || len(rec.Segments) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// target duration of event playlist must not change while it grows
+	targetDuration := mpegts.MaxDuration(recordingSegmentDuration)
+	finished := rec.Status == recordingCompleted || rec.Status == recordingFailed
+	playlistType := "EVENT"
+	if finished {
+		playlistType = "VOD"
+	}
+	fileURL := url.PathEscape(rec.ID) + ".ts?token=" + url.QueryEscape(vars["token"])
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:4\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration.Seconds())))
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:" + playlistType + "\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	for _, seg := range rec.Segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", seg.Duration.Seconds(), seg.Size, seg.Offset, fileURL)
+	}
+	if finished {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	w.Write([]byte(b.String()))
+}
+
+// handleRecordingFile serves TS file of recording with range support
+func handleRecordingFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeRecordings(w, listName, vars["token"]) {
+		return
+	}
+	rec, err := recordings.get(listName, vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(recordings.path(&rec))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// authorizeRecordings checks list token, recordings which aren't enabled are not found
+func authorizeRecordings(w http.ResponseWriter, listName, token string) bool {
+	if !authorizeList(w, listName, token) {
+		return false
+	}
+	if recordings == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		logger.Debug("Unable to write response: " + err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
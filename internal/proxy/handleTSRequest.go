@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+
+	"github.com/gorilla/mux"
+)
+
+// handleTSStream serves live HLS channel as one continuous MPEG-TS stream for players which can't play HLS
+func handleTSStream(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listName := vars["list"]
+	if !authorizeList(w, listName, vars["token"]) {
+		return
+	}
+	variant := r.URL.Query().Get("variant")
+	if !isValidVariantPreference(variant) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ch, err := getChannel(r.Context(), listName, vars["channel"])
+	if errors.Is(err, errChannelNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to get channels of list " + listName + ": " + err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	// playlist and segment requests are made by proxy itself, whole stream holds one connection
+	releaseConnection, err := lockListConnection(listName)
+	if err != nil {
+		logger.Warn("Too many connections for list " + listName)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer releaseConnection()
+
+	client, err := GetListClient(listName)
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	key := listName + "|" + ch.ID
+	logger.Info("Remuxing: " + key)
+	rm := newHLSRemuxer(listName, client, w, func() {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+		w.WriteHeader(http.StatusOK)
+	})
+	err = rm.run(r.Context(), ch.URL, variant)
+	switch {
+	case r.Context().Err() != nil:
+		logger.Debug("Connection closed.")
+	case err != nil && !rm.started:
+		logger.Warn("Unable to remux " + key + ": " + err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	case err != nil:
+		logger.Warn("Remuxing of " + key + " interrupted: " + err.Error())
+	}
+	logger.Info("Completed: " + key)
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHLSPlaylistSize limits playlists read by proxy itself
+const maxHLSPlaylistSize = 4 << 20
+
+var errNotHLSPlaylist = errors.New("Body is not HLS playlist")
+
+// hlsPlaylist is parsed master or media playlist, master playlist has only variants
+type hlsPlaylist struct {
+	variants       []hlsVariant
+	targetDuration time.Duration
+	mediaSequence  int
+	segments       []hlsSegment
+	ended          bool
+	// hasMap is set for fragmented MP4 playlists which need initialization section
+	hasMap bool
+}
+
+// hlsVariant is #EXT-X-STREAM-INF entry of master playlist
+type hlsVariant struct {
+	url        string
+	bandwidth  int
+	resolution string
+	codecs     string
+}
+
+// hlsSegment is media segment, url is absolute
+type hlsSegment struct {
+	url           string
+	seq           int
+	duration      time.Duration
+	discontinuity bool
+	key           hlsKey
+}
+
+// hlsKey is #EXT-X-KEY in effect for segment, method is empty for unencrypted segments
+type hlsKey struct {
+	method string
+	url    string
+	iv     []byte
+}
+
+// parseHLSPlaylist parses master or media playlist, relative urls are resolved against baseURL
+func parseHLSPlaylist(body io.Reader, baseURL string) (*hlsPlaylist, error) {
+	br := bufio.NewReader(io.LimitReader(body, maxHLSPlaylistSize))
+	pl := &hlsPlaylist{}
+	var variant *hlsVariant
+	var segment hlsSegment
+	var key hlsKey
+	header := false
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if !header && line != "" {
+			if !strings.HasPrefix(strings.TrimPrefix(line, "\xEF\xBB\xBF"), "#EXTM3U") {
+				return nil, errNotHLSPlaylist
+			}
+			header = true
+			line = ""
+		}
+
+		tag, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			tag, value = line[:i], line[i+1:]
+		}
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseAttributeList(value)
+			bandwidth, _ := strconv.Atoi(attrs["BANDWIDTH"])
+			variant = &hlsVariant{bandwidth: bandwidth, resolution: attrs["RESOLUTION"], codecs: attrs["CODECS"]}
+		case tag == "#EXT-X-TARGETDURATION":
+			if d, err := strconv.ParseFloat(value, 64); err == nil {
+				pl.targetDuration = time.Duration(d * float64(time.Second))
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			pl.mediaSequence, _ = strconv.Atoi(value)
+		case tag == "#EXTINF":
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value = value[:i]
+			}
+			if d, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				segment.duration = time.Duration(d * float64(time.Second))
+			}
+		case tag == "#EXT-X-DISCONTINUITY":
+			segment.discontinuity = true
+		case tag == "#EXT-X-KEY":
+			attrs := parseAttributeList(value)
+			key = hlsKey{method: attrs["METHOD"]}
+			if key.method == "NONE" {
+				key.method = ""
+			}
+			if uri, ok := attrs["URI"]; ok {
+				key.url = resolveURL(baseURL, uri)
+			}
+			if iv := attrs["IV"]; len(iv) > 2 && (strings.HasPrefix(iv, "0x") || strings.HasPrefix(iv, "0X")) {
+				key.iv, _ = hex.DecodeString(iv[2:])
+			}
+		case tag == "#EXT-X-MAP":
+			pl.hasMap = true
+		case tag == "#EXT-X-ENDLIST":
+			pl.ended = true
+		case line[0] == '#':
+		case variant != nil:
+			variant.url = resolveURL(baseURL, line)
+			pl.variants = append(pl.variants, *variant)
+			variant = nil
+		default:
+			segment.url = resolveURL(baseURL, line)
+			segment.seq = pl.mediaSequence + len(pl.segments)
+			segment.key = key
+			pl.segments = append(pl.segments, segment)
+			segment = hlsSegment{}
+		}
+
+		if err == io.EOF {
+			if !header {
+				return nil, errNotHLSPlaylist
+			}
+			return pl, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseAttributeList parses NAME=value,NAME="quoted, value" attributes of HLS tag, quotes are removed
+func parseAttributeList(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.ToUpper(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		value := ""
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+			if i := strings.IndexByte(s, ','); i >= 0 {
+				s = s[i+1:]
+			} else {
+				s = ""
+			}
+		} else if end := strings.IndexByte(s, ','); end >= 0 {
+			value, s = s[:end], s[end+1:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[name] = strings.TrimSpace(value)
+	}
+	return attrs
+}
+
+// selectVariant picks variant by preference: highest, lowest or bandwidth in bits per second.
+// For bandwidth the best variant not exceeding it is used, or the lowest one when all exceed it.
+func selectVariant(variants []hlsVariant, preference string) (hlsVariant, error) {
+	if len(variants) == 0 {
+		return hlsVariant{}, errors.New("Master playlist has no variants")
+	}
+	lowest, highest := variants[0], variants[0]
+	for _, v := range variants[1:] {
+		if v.bandwidth < lowest.bandwidth {
+			lowest = v
+		}
+		if v.bandwidth > highest.bandwidth {
+			highest = v
+		}
+	}
+
+	switch preference {
+	case "", "highest":
+		return highest, nil
+	case "lowest":
+		return lowest, nil
+	}
+	limit, err := strconv.Atoi(preference)
+	if err != nil || limit <= 0 {
+		return hlsVariant{}, errors.New("Invalid variant " + preference + ", expected highest, lowest or bandwidth")
+	}
+	best, found := lowest, false
+	for _, v := range variants {
+		if v.bandwidth <= limit && (!found || v.bandwidth > best.bandwidth) {
+			best, found = v, true
+		}
+	}
+	return best, nil
+}
+
+// isValidVariantPreference reports if preference is accepted by selectVariant
+func isValidVariantPreference(preference string) bool {
+	_, err := selectVariant([]hlsVariant{{}}, preference)
+	return err == nil
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+)
+
+const (
+	// remuxLiveEdgeSegments is number of latest segments live playlist is played from
+	remuxLiveEdgeSegments = 3
+	// remuxStallFactor is number of target durations without new segment after which stream ends
+	remuxStallFactor     = 6
+	remuxMaxFailures     = 3
+	remuxMaxSegmentSize  = 64 << 20
+	remuxDefaultDuration = 10 * time.Second
+)
+
+// hlsRemuxer follows live HLS media playlist and writes its MPEG-TS segments as one continuous stream
+type hlsRemuxer struct {
+	listName string
+	client   *http.Client
+	w        io.Writer
+	joiner   *mpegts.Joiner
+	keys     map[string][]byte
+	// onStart is called before the first segment is written, e.g. to write response headers
+	onStart func()
+	started bool
+	// stallTimeout limits download of segment, so provider which stops sending it doesn't hang the stream
+	stallTimeout time.Duration
+}
+
+// newHLSRemuxer returns remuxer writing stream to w, it is flushed after every segment when it is http.Flusher
+func newHLSRemuxer(listName string, client *http.Client, w io.Writer, onStart func()) *hlsRemuxer {
+	return &hlsRemuxer{
+		listName: listName,
+		client:   client,
+		w:        w,
+		joiner:   mpegts.NewJoiner(w),
+		keys:     make(map[string][]byte),
+		onStart:  onStart,
+	}
+}
+
+// run plays playlist until it ends, stalls or ctx is done, variant of master playlist is chosen by preference
+func (rm *hlsRemuxer) run(ctx context.Context, playlistURL, preference string) error {
+	pl, err := rm.loadPlaylist(ctx, playlistURL)
+	if err != nil {
+		return err
+	}
+	if len(pl.variants) > 0 {
+		v, err := selectVariant(pl.variants, preference)
+		if err != nil {
+			return err
+		}
+		logger.Debug("Variant " + strconv.Itoa(v.bandwidth) + " selected: " + v.url)
+		playlistURL = v.url
+		if pl, err = rm.loadPlaylist(ctx, playlistURL); err != nil {
+			return err
+		}
+		if len(pl.variants) > 0 {
+			return errors.New("Variant " + playlistURL + " is master playlist")
+		}
+	}
+	if pl.hasMap {
+		return errors.New("Fragmented MP4 segments can't be remuxed to MPEG-TS")
+	}
+
+	nextSeq := 0
+	following := false
+	// missed is set when segment was skipped, next written one is discontinuous
+	missed := false
+	lastNew := time.Now()
+	failures := 0
+	for {
+		targetDuration := pl.targetDuration
+		if targetDuration <= 0 {
+			targetDuration = remuxDefaultDuration
+		}
+		rm.stallTimeout = remuxStallFactor * targetDuration
+
+		segments := pl.segments
+		n := len(segments)
+		if !following && n > 0 {
+			if !pl.ended && n > remuxLiveEdgeSegments {
+				segments = segments[n-remuxLiveEdgeSegments:]
+			}
+			nextSeq = segments[0].seq
+			following = true
+		} else if n > 0 && segments[n-1].seq+n < nextSeq {
+			logger.Debug("Media sequence of " + playlistURL + " restarted")
+			if n > remuxLiveEdgeSegments {
+				segments = segments[n-remuxLiveEdgeSegments:]
+			}
+			nextSeq = segments[0].seq
+			missed = true
+		}
+
+		newSegments := false
+		for _, seg := range segments {
+			if seg.seq < nextSeq {
+				continue
+			}
+			discontinuity := missed || seg.discontinuity || seg.seq > nextSeq
+			nextSeq = seg.seq + 1
+			newSegments = true
+
+			data, err := rm.fetchSegment(ctx, seg)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == nil {
+				if kind, _ := sniffContent(data); kind != "mpegts" {
+					err = fmt.Errorf("%w but %s", errNotMPEGTS, kind)
+				}
+			}
+			if err != nil {
+				if !rm.started && errors.Is(err, errNotMPEGTS) {
+					return err
+				}
+				logger.Warn("Skipping segment " + seg.url + ": " + err.Error())
+				missed = true
+				continue
+			}
+			if err := rm.writeSegment(data, discontinuity); err != nil {
+				return err
+			}
+			missed = false
+		}
+		if pl.ended {
+			return nil
+		}
+
+		wait := targetDuration
+		if newSegments {
+			lastNew = time.Now()
+		} else {
+			// playlist didn't change, it is reloaded sooner
+			wait /= 2
+			if time.Since(lastNew) > remuxStallFactor*targetDuration {
+				return errors.New("No new segments of " + playlistURL + " in " + time.Since(lastNew).Round(time.Second).String())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		reloaded, err := rm.loadPlaylist(ctx, playlistURL)
+		if err != nil {
+			if failures++; failures >= remuxMaxFailures || ctx.Err() != nil {
+				return err
+			}
+			logger.Warn("Unable to reload playlist " + playlistURL + ": " + err.Error())
+			continue
+		}
+		failures = 0
+		pl = reloaded
+	}
+}
+
+func (rm *hlsRemuxer) loadPlaylist(ctx context.Context, playlistURL string) (*hlsPlaylist, error) {
+	resp, err := rm.get(ctx, playlistURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return parseHLSPlaylist(resp.Body, resp.Request.URL.String())
+}
+
+// fetchSegment downloads and decrypts segment within stall timeout, failed download is tried once more
+func (rm *hlsRemuxer) fetchSegment(ctx context.Context, seg hlsSegment) ([]byte, error) {
+	var data []byte
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if data, err = rm.downloadSegment(ctx, seg.url); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil || seg.key.method == "" {
+		return data, err
+	}
+	return rm.decrypt(ctx, seg, data)
+}
+
+func (rm *hlsRemuxer) decrypt(ctx context.Context, seg hlsSegment, data []byte) ([]byte, error) {
+	if seg.key.method != "AES-128" {
+		return nil, errors.New("Unsupported encryption " + seg.key.method)
+	}
+	key, ok := rm.keys[seg.key.url]
+	if !ok {
+		var err error
+		if key, err = rm.download(ctx, seg.key.url, aes.BlockSize); err != nil {
+			return nil, err
+		}
+		if len(key) != aes.BlockSize {
+			return nil, errors.New("Invalid key " + seg.key.url)
+		}
+		rm.keys[seg.key.url] = key
+	}
+
+	iv := seg.key.iv
+	if len(iv) != aes.BlockSize {
+		// without IV attribute media sequence number is used
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(seg.seq))
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("Encrypted segment size is not multiple of block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	// PKCS7 padding
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("Invalid padding of decrypted segment")
+	}
+	return data[:len(data)-pad], nil
+}
+
+func (rm *hlsRemuxer) downloadSegment(ctx context.Context, urlString string) ([]byte, error) {
+	if rm.stallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rm.stallTimeout)
+		defer cancel()
+	}
+	data, err := rm.download(ctx, urlString, remuxMaxSegmentSize)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errors.New("No data of " + urlString + " in " + rm.stallTimeout.String())
+	}
+	return data, err
+}
+
+// download reads whole body of url, bodies over limit are refused
+func (rm *hlsRemuxer) download(ctx context.Context, urlString string, limit int64) ([]byte, error) {
+	resp, err := rm.get(ctx, urlString)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errors.New("Body of " + urlString + " is bigger than " + strconv.FormatInt(limit, 10) + " bytes")
+	}
+	return data, nil
+}
+
+func (rm *hlsRemuxer) get(ctx context.Context, urlString string) (*http.Response, error) {
+	resp, err := getFollowingRedirects(ctx, rm.client, urlString, rm.listName)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode) + " of " + urlString)
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// writeSegment writes segment to stream, onStart is called before the first one
+func (rm *hlsRemuxer) writeSegment(data []byte, discontinuity bool) error {
+	if !rm.started {
+		if rm.onStart != nil {
+			rm.onStart()
+		}
+		rm.started = true
+	}
+	rm.joiner.StartSegment(discontinuity)
+	if _, err := rm.joiner.Write(data); err != nil {
+		return err
+	}
+	if f, ok := rm.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
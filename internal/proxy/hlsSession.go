@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+)
+
+// hlsSession is a lease on a single list connection slot shared by all
+// playlist and segment requests of one HLS viewer
+type hlsSession struct {
+	key     string
+	active  int
+	timer   *time.Timer
+	release func()
+}
+
+var hlsSessions = make(map[string]*hlsSession)
+var hlsSessionsMu sync.Mutex
+
+var hlsPlaylistExtensions = [...]string{"m3u8"}
+
+func isHLSPlaylistExtension(pathExtension string) bool {
+	for _, ext := range hlsPlaylistExtensions {
+		if "."+ext == pathExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireListConnection locks list connection for request of real url and returns function releasing it.
+// HLS playlist requests open a session lease keyed by lineage of the stream, targets of playlists and segments
+// found in it are bound to the lineage and they are accounted on that lease until it stays idle for server.hlsSessionTimeout.
+// Other requests take their own slot.
+func acquireListConnection(r *http.Request, listName, realURL string) (func(), error) {
+	if !isHLSSessionRequest(r, realURL) {
+		return lockListConnection(listName)
+	}
+	key := hlsSessionKey(r, listName, streamLineage(r, realURL))
+	if release, ok := joinHLSSession(key); ok {
+		return release, nil
+	}
+
+	release, err := lockListConnection(listName)
+	if err != nil {
+		return nil, err
+	}
+
+	hlsSessionsMu.Lock()
+	if s, ok := hlsSessions[key]; ok {
+		// concurrent request created session in the meantime
+		s.active++
+		s.stopTimer()
+		hlsSessionsMu.Unlock()
+		release()
+		return func() { releaseHLSSession(s) }, nil
+	}
+	s := &hlsSession{key: key, active: 1, release: release}
+	hlsSessions[key] = s
+	hlsSessionsMu.Unlock()
+	logger.Debug("HLS session started: " + key)
+
+	return func() { releaseHLSSession(s) }, nil
+}
+
+// streamLineage returns lineage of HLS stream request belongs to, playlist opened directly starts new lineage
+func streamLineage(r *http.Request, realURL string) string {
+	if stream := urlconvert.StreamOfRequest(r); stream != "" {
+		return stream
+	}
+	sum := sha256.Sum256([]byte(realURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// isHLSSessionRequest reports if request of real url is accounted on HLS session lease, only playlists
+// and urls emitted by rewriter of HLS playlist with target bound to their path join it
+func isHLSSessionRequest(r *http.Request, realURL string) bool {
+	return isHLSPlaylistExtension(urlExtension(realURL)) || urlconvert.StreamOfRequest(r) != ""
+}
+
+func urlExtension(realURL string) string {
+	u, err := url.Parse(realURL)
+	if err != nil {
+		return ""
+	}
+	return filepath.Ext(u.Path)
+}
+
+func joinHLSSession(key string) (func(), bool) {
+	hlsSessionsMu.Lock()
+	defer hlsSessionsMu.Unlock()
+
+	s, ok := hlsSessions[key]
+	if !ok {
+		return nil, false
+	}
+	s.active++
+	s.stopTimer()
+
+	return func() { releaseHLSSession(s) }, true
+}
+
+func releaseHLSSession(s *hlsSession) {
+	hlsSessionsMu.Lock()
+	defer hlsSessionsMu.Unlock()
+
+	s.active--
+	if s.active > 0 {
+		return
+	}
+	timeout := config.GetConfig().Server.HLSSessionTimeout
+	s.timer = time.AfterFunc(timeout, func() { expireHLSSession(s) })
+}
+
+func expireHLSSession(s *hlsSession) {
+	hlsSessionsMu.Lock()
+	if s.active > 0 || hlsSessions[s.key] != s {
+		hlsSessionsMu.Unlock()
+		return
+	}
+	delete(hlsSessions, s.key)
+	hlsSessionsMu.Unlock()
+
+	s.release()
+	logger.Debug("HLS session expired: " + s.key)
+}
+
+func (s *hlsSession) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// hlsSessionKey identifies viewer of stream by list, client address, user agent and lineage of the stream
+func hlsSessionKey(r *http.Request, listName, stream string) string {
+	return listName + "|" + clientIP(r) + "|" + r.Header.Get("user-agent") + "|" + stream
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+)
+
+// manifestTTLFactor is part of target duration rewritten media playlist is shared for,
+// so players polling it always get fresh one before next segment appears
+const manifestTTLFactor = 0.5
+
+var errManifestTooLarge = errors.New("Manifest is bigger than rewrite buffer")
+
+// cachedManifest is rewritten HLS playlist with provider headers
+type cachedManifest struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// manifestCache shares rewritten HLS playlists between players of the same list.
+// Concurrent requests are fetched once, media playlists are kept for part of their target duration.
+// Keys contain list name because rewritten urls carry targets encrypted by list token.
+type manifestCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedManifest
+	flights flightGroup
+}
+
+var manifests = &manifestCache{entries: make(map[string]*cachedManifest)}
+
+func (c *manifestCache) get(key string) (*cachedManifest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.entries[key]
+	if !ok || time.Now().After(m.expires) {
+		return nil, false
+	}
+	return m, true
+}
+
+func (c *manifestCache) store(key string, m *cachedManifest) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = m
+}
+
+// serveSharedManifest serves HLS playlist fetched and rewritten once for all concurrent players of list.
+// Returns false when request has to be proxied as usual.
+func serveSharedManifest(w http.ResponseWriter, r *http.Request, realURL, listName, pathExtension string) bool {
+	if r.Method != http.MethodGet || !isHLSPlaylistExtension(pathExtension) {
+		return false
+	}
+
+	// players with different variant filters get different master playlists, urls of playlist carry its lineage
+	variants := clientVariantFilter(r, listName)
+	key := listName + "|" + streamLineage(r, realURL) + "|" + realURL
+	if variants != nil {
+		key = listName + "|" + variants.key + "|" + streamLineage(r, realURL) + "|" + realURL
+	}
+	// every viewer opens or joins its session lease, so its segment requests are accounted on it
+	releaseConnection, err := acquireListConnection(r, listName, realURL)
+	if err != nil {
+		logger.Warn("Too many connections for list " + listName)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}
+	defer releaseConnection()
+
+	m, hit := manifests.get(key)
+	if !hit {
+		// fetch can outlive request which started it, so it gets its own copy
+		fetchReq := r.Clone(context.Background())
+		v, err := manifests.flights.do(r.Context(), key, func() (interface{}, error) {
+			return fetchManifest(fetchReq, realURL, listName, pathExtension, key, variants)
+		})
+		if r.Context().Err() != nil {
+			// client is gone
+			return true
+		}
+		if err != nil {
+			logger.Debug("Manifest not shared (" + err.Error() + "): " + realURL)
+			return false
+		}
+		m = v.(*cachedManifest)
+	}
+
+	logger.Debug("Serving shared manifest: " + realURL)
+	copyResponseHeaders(w.Header(), m.header, listName, true)
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	bw := newLengthBufferWriter(w, http.StatusOK)
+	cw := newCompressWriter(bw, w.Header(), r)
+	if _, err := cw.Write(m.body); err != nil {
+		logger.Debug("Unable to write response: " + err.Error())
+	}
+	if err := cw.Close(); err != nil {
+		logger.Debug("Unable to compress response: " + err.Error())
+	}
+	if err := bw.Close(); err != nil {
+		logger.Debug("Unable to write response: " + err.Error())
+	}
+	return true
+}
+
+// fetchManifest downloads and rewrites playlist on session lease of player who requested it first
+func fetchManifest(r *http.Request, realURL, listName, pathExtension, key string, variants *variantFilter) (*cachedManifest, error) {
+	releaseConnection, err := acquireListConnection(r, listName, realURL)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseConnection()
+
+	req, err := http.NewRequest(http.MethodGet, realURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setUpstreamHeaders(req, r, listName)
+	dropRangeHeaders(req)
+	client, err := GetListClient(listName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// redirects and errors go through regular proxy path
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return nil, err
+	}
+	if parse, detectedBy := classifyResponse(resp, resp.Header.Get("content-type"), pathExtension, listName); !parse {
+		return nil, errors.New("Response is not a playlist but " + detectedBy)
+	}
+
+	p, err := newPlaylistRewriter(listName, r.URL.Query().Get(urlconvert.GetParamEncTarget()))
+	if err != nil {
+		return nil, err
+	}
+	p.baseURL = resp.Request.URL
+	p.variants = variants
+	p.stream = streamLineage(r, realURL)
+	buf := &limitedBuffer{limit: int(config.GetConfig().Server.RewriteBufferSize)}
+	if err := p.rewrite(context.Background(), resp.Body, buf); err != nil {
+		return nil, err
+	}
+
+	m := &cachedManifest{header: resp.Header, body: buf.Bytes()}
+	// master playlists have no target duration, they are only shared while being fetched
+	if p.targetDuration > 0 {
+		m.expires = time.Now().Add(time.Duration(float64(p.targetDuration) * manifestTTLFactor))
+		manifests.store(key, m)
+	}
+	logger.Info("Parsing: [shared] " + realURL)
+
+	return m, nil
+}
+
+// limitedBuffer is buffer refusing writes over its limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errManifestTooLarge
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,556 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+)
+
+const rewriteBufferSize = 64 * 1024
+
+var (
+	extM3UTag         = []byte("#EXTM3U")
+	targetDurationTag = []byte("#EXT-X-TARGETDURATION:")
+	byteRangeTag      = []byte("#EXT-X-BYTERANGE:")
+	streamInfTag      = []byte("#EXT-X-STREAM-INF:")
+	iFrameStreamTag   = []byte("#EXT-X-I-FRAME-STREAM-INF:")
+	extinfTag         = []byte("#EXTINF:")
+	extGrpTag         = []byte("#EXTGRP:")
+	catchupMarkers    = [...][]byte{[]byte("catchup"), []byte("timeshift="), []byte("tvg-rec=")}
+	uriAttributes     = [...][]byte{[]byte(`URI="`), []byte(`uri="`)}
+	httpPrefix        = []byte("http")
+	// hlsMarkers are tags found only in HLS master and media playlists, not in lists of channels
+	hlsMarkers = [...][]byte{targetDurationTag, streamInfTag, iFrameStreamTag, []byte("#EXT-X-MEDIA")}
+)
+
+// playlistRewriter converts urls and paths of playlists, epg and other text bodies to proxy ones.
+// Body is read in one pass line by line without limit of line length, urls are found by scanning bytes
+// and only their exact spans are replaced.
+type playlistRewriter struct {
+	listName  string
+	encURL    string
+	converter *urlconvert.URLConverter
+	isM3U     bool
+	line      []byte
+	out       []byte
+
+	// baseURL is real url of playlist, when it is set segments of media playlists are registered in segment cache
+	baseURL        *url.URL
+	segments       *segmentCache
+	targetDuration time.Duration
+	// byteRange is set by #EXT-X-BYTERANGE tag, uri following it is part of bigger file and isn't cached
+	byteRange bool
+
+	// variants filters variants of master playlists, they are held in pending until the end of playlist
+	variants       *variantFilter
+	pending        []pendingVariant
+	currentVariant *pendingVariant
+
+	// stream is lineage bound to targets of urls of HLS playlist, so its playlists and segments share session of the viewer
+	stream string
+	isHLS  bool
+
+	// dead filters streams which failed their last probe
+	dead *deadChannelFilter
+
+	// entryExtinf is #EXTINF line held with following tags in entryTags until uri of the entry
+	holdingEntry bool
+	entryExtinf  []byte
+	entryTags    []byte
+	released     []byte
+	catchupBase  string
+}
+
+func newPlaylistRewriter(listName, encURL string) (*playlistRewriter, error) {
+	converter, err := urlconvert.NewURLConverter(config.GetConfig().App.URL, listName)
+	if err != nil {
+		return nil, err
+	}
+	return &playlistRewriter{listName: listName, encURL: encURL, converter: converter, segments: getSegmentCache(), dead: newDeadChannelFilter(listName)}, nil
+}
+
+// rewriteBody converts urls and paths found in body to proxy ones, encURL is target param used for relative paths
+func rewriteBody(ctx context.Context, body io.Reader, w io.Writer, listName, encURL string) error {
+	p, err := newPlaylistRewriter(listName, encURL)
+	if err != nil {
+		return err
+	}
+	return p.rewrite(ctx, body, w)
+}
+
+func (p *playlistRewriter) rewrite(ctx context.Context, body io.Reader, w io.Writer) error {
+	br := bufio.NewReaderSize(body, rewriteBufferSize)
+	bw := bufio.NewWriterSize(w, rewriteBufferSize)
+	for {
+		line, err := p.readLine(br)
+		if len(line) > 0 || err == nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, werr := bw.Write(p.rewriteLine(line)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			released, _ := p.releaseEntry(p.released[:0], nil)
+			if _, err := bw.Write(released); err != nil {
+				return err
+			}
+			if err := p.writeVariants(bw); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine returns next line without line ending, long lines are joined from buffer sized chunks
+func (p *playlistRewriter) readLine(br *bufio.Reader) ([]byte, error) {
+	p.line = p.line[:0]
+	for {
+		chunk, err := br.ReadSlice('\n')
+		p.line = append(p.line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			line := bytes.TrimSuffix(p.line, []byte("\n"))
+			return bytes.TrimSuffix(line, []byte("\r")), err
+		}
+	}
+}
+
+// rewriteLine returns converted line ending with new line, returned slice is valid until next call
+func (p *playlistRewriter) rewriteLine(line []byte) []byte {
+	if !p.isM3U {
+		p.isM3U = bytes.Contains(line, extM3UTag)
+	}
+
+	out := p.out[:0]
+	trimmed := bytes.TrimSpace(line)
+	switch {
+	case p.isM3U && len(trimmed) > 0 && trimmed[0] != '#':
+		// uri line of media or stream
+		p.registerSegment(trimmed)
+		out = p.appendURI(out, line)
+	case p.isM3U:
+		if !p.isHLS && p.stream != "" && hasHLSMarker(trimmed) {
+			p.isHLS = true
+			p.converter.SetStream(p.stream, p.baseURL)
+		}
+		if bytes.HasPrefix(trimmed, targetDurationTag) {
+			if seconds, err := strconv.ParseFloat(string(trimmed[len(targetDurationTag):]), 64); err == nil {
+				p.targetDuration = time.Duration(seconds * float64(time.Second))
+			}
+		}
+		if bytes.HasPrefix(trimmed, byteRangeTag) {
+			p.byteRange = true
+		}
+		out = p.appendTag(out, line)
+	default:
+		out = p.appendURLs(out, line)
+	}
+	out = append(out, '\n')
+	p.out = out
+	if p.isM3U && (p.holdingEntry || bytes.HasPrefix(trimmed, extinfTag) && (p.dead != nil || hasCatchupMarker(trimmed))) {
+		return p.holdEntry(trimmed, out)
+	}
+	if p.variants != nil && p.isM3U {
+		return p.holdVariant(trimmed, out)
+	}
+	return out
+}
+
+// holdEntry holds #EXTINF line and tags following it until uri of the entry, catch-up url is made of stream url
+// and dead streams are hidden or moved to offline group. Returned slice is valid until next call.
+func (p *playlistRewriter) holdEntry(trimmed, out []byte) []byte {
+	isURI := len(trimmed) > 0 && trimmed[0] != '#'
+	if !isURI && !bytes.HasPrefix(trimmed, extinfTag) {
+		p.entryTags = append(p.entryTags, out...)
+		return nil
+	}
+
+	if isURI {
+		released, keep := p.releaseEntry(p.released[:0], trimmed)
+		if keep {
+			released = append(released, out...)
+		}
+		p.released = released
+		return released
+	}
+	released, _ := p.releaseEntry(p.released[:0], nil)
+	if p.dead != nil || hasCatchupMarker(trimmed) {
+		p.entryExtinf = append(p.entryExtinf[:0], trimmed...)
+		p.holdingEntry = true
+	} else {
+		released = append(released, out...)
+	}
+	p.released = released
+	return released
+}
+
+// releaseEntry appends held entry, reports false when entry with stream uri should be dropped
+func (p *playlistRewriter) releaseEntry(dst, uri []byte) ([]byte, bool) {
+	if !p.holdingEntry {
+		return dst, true
+	}
+	p.holdingEntry = false
+	defer func() { p.entryTags = p.entryTags[:0] }()
+
+	streamURL := p.streamURL(uri)
+	values := make(map[string]string)
+	offline := p.dead != nil && streamURL != "" && p.dead.urls[streamURL]
+	if offline {
+		if p.dead.hide {
+			return dst, false
+		}
+		values["group-title"] = p.dead.group
+	}
+	if catchupURL, days := p.catchupURL(streamURL); catchupURL != "" {
+		values["catchup"] = catchupDefault
+		values["catchup-source"] = catchupURL
+		if days != "" {
+			values["catchup-days"] = days
+		}
+	}
+
+	if len(values) > 0 {
+		dst = p.appendExtinf(dst, string(p.entryExtinf), values)
+	} else {
+		dst = p.appendTag(dst, p.entryExtinf)
+	}
+	dst = append(dst, '\n')
+	if !offline {
+		return append(dst, p.entryTags...), true
+	}
+	// group of #EXTGRP tag is used by some players instead of group-title
+	tags := p.entryTags
+	for len(tags) > 0 {
+		end := bytes.IndexByte(tags, '\n') + 1
+		if bytes.HasPrefix(bytes.TrimSpace(tags[:end]), extGrpTag) {
+			dst = append(dst, extGrpTag...)
+			dst = append(dst, p.dead.group...)
+			dst = append(dst, '\n')
+		} else {
+			dst = append(dst, tags[:end]...)
+		}
+		tags = tags[end:]
+	}
+	return dst, true
+}
+
+// streamURL returns real url of stream uri of entry, empty when it isn't absolute url
+func (p *playlistRewriter) streamURL(uri []byte) string {
+	if uri == nil {
+		return ""
+	}
+	var streamURL *url.URL
+	var err error
+	if p.baseURL != nil {
+		streamURL, err = p.baseURL.Parse(string(uri))
+	} else {
+		streamURL, err = url.Parse(string(uri))
+	}
+	if err != nil || !streamURL.IsAbs() {
+		return ""
+	}
+	return streamURL.String()
+}
+
+// catchupURL returns proxy catch-up url of held entry and its archive days of Xtream Codes, empty url when entry has no usable catch-up
+func (p *playlistRewriter) catchupURL(streamURL string) (string, string) {
+	if streamURL == "" || !hasCatchupMarker(p.entryExtinf) {
+		return "", ""
+	}
+	attrs := parseExtinf(string(p.entryExtinf)).Attrs
+	source, ok := parseCatchup(attrs, streamURL)
+	if !ok {
+		return "", ""
+	}
+	encoded, err := source.encode(p.listName)
+	if err != nil {
+		logger.Warn("Unable to encode catch-up of " + source.url + ": " + err.Error())
+		return "", ""
+	}
+
+	if p.catchupBase == "" {
+		app, err := url.Parse(config.GetConfig().App.URL)
+		if err != nil {
+			return "", ""
+		}
+		base := url.URL{Scheme: app.Scheme, User: app.User, Host: app.Host, Path: "/catchup/" + p.listName + "/"}
+		p.catchupBase = base.String()
+	}
+	days := ""
+	if attrs["catchup-days"] == "" {
+		days = xtreamDays(attrs)
+	}
+	return p.catchupBase + encoded + "?" + catchupQuery, days
+}
+
+// appendExtinf appends #EXTINF line with attributes set to values, missing ones are added after the others,
+// other attributes are rewritten as tag
+func (p *playlistRewriter) appendExtinf(dst []byte, line string, values map[string]string) []byte {
+	attrs, attrsEnd := scanExtinf(line)
+	pos := 0
+	for _, a := range attrs {
+		value, ok := values[a.key]
+		if !ok {
+			continue
+		}
+		dst = p.appendTag(dst, []byte(line[pos:a.start]))
+		dst = append(dst, '"')
+		dst = append(dst, value...)
+		dst = append(dst, '"')
+		pos = a.end
+		delete(values, a.key)
+	}
+	dst = p.appendTag(dst, []byte(line[pos:attrsEnd]))
+	for _, key := range [...]string{"group-title", "catchup", "catchup-days", "catchup-source"} {
+		if value, ok := values[key]; ok {
+			dst = append(dst, ' ')
+			dst = append(dst, key...)
+			dst = append(dst, `="`...)
+			dst = append(dst, value...)
+			dst = append(dst, '"')
+		}
+	}
+	if attrsEnd < len(line) && line[attrsEnd] != ',' {
+		dst = append(dst, ' ')
+	}
+	return p.appendTag(dst, []byte(line[attrsEnd:]))
+}
+
+func hasHLSMarker(line []byte) bool {
+	for _, marker := range hlsMarkers {
+		if bytes.HasPrefix(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCatchupMarker(line []byte) bool {
+	for _, marker := range catchupMarkers {
+		if bytes.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdVariant keeps rewritten lines of #EXT-X-STREAM-INF variant until its uri, lines of other tags are returned,
+// I-frame variants not passing the filter are dropped
+func (p *playlistRewriter) holdVariant(trimmed, out []byte) []byte {
+	if bytes.HasPrefix(trimmed, iFrameStreamTag) {
+		if !p.variants.allows(parseAttributeList(string(trimmed[len(iFrameStreamTag):]))) {
+			return nil
+		}
+		return out
+	}
+	if bytes.HasPrefix(trimmed, streamInfTag) {
+		attrs := parseAttributeList(string(trimmed[len(streamInfTag):]))
+		bandwidth, _ := strconv.Atoi(attrs["BANDWIDTH"])
+		width, height, _ := config.ParseResolution(attrs["RESOLUTION"])
+		p.currentVariant = &pendingVariant{
+			bandwidth:     bandwidth,
+			pixels:        width * height,
+			allowed:       p.variants.allows(attrs),
+			codecsAllowed: p.variants.allowsCodecs(attrs),
+		}
+	}
+	if p.currentVariant == nil {
+		return out
+	}
+
+	p.currentVariant.data = append(p.currentVariant.data, out...)
+	if len(trimmed) > 0 && trimmed[0] != '#' {
+		p.pending = append(p.pending, *p.currentVariant)
+		p.currentVariant = nil
+	}
+	return nil
+}
+
+// writeVariants writes variants chosen by filter, tag without uri at the end of playlist is written unchanged
+func (p *playlistRewriter) writeVariants(w io.Writer) error {
+	if p.variants == nil {
+		return nil
+	}
+	for _, v := range p.variants.choose(p.pending) {
+		if _, err := w.Write(v.data); err != nil {
+			return err
+		}
+	}
+	if p.currentVariant != nil {
+		if _, err := w.Write(p.currentVariant.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerSegment registers uri of media playlist in segment cache, playlists without target duration are master ones.
+// Uris of byte ranges are removed from cache, their requests are proxied with range.
+func (p *playlistRewriter) registerSegment(uri []byte) {
+	byteRange := p.byteRange
+	p.byteRange = false
+	if p.baseURL == nil || p.segments == nil || p.targetDuration <= 0 {
+		return
+	}
+	realURL, err := p.baseURL.Parse(string(uri))
+	if err != nil || (realURL.Scheme != "http" && realURL.Scheme != "https") {
+		return
+	}
+	if byteRange {
+		p.segments.forget(segmentKey(realURL.String()))
+		return
+	}
+	p.segments.register(segmentKey(realURL.String()), segmentTTLFactor*p.targetDuration)
+}
+
+// appendTag appends tag line with converted URI attributes and urls
+func (p *playlistRewriter) appendTag(dst, line []byte) []byte {
+	for {
+		start, end := findURIAttribute(line)
+		if start < 0 {
+			return p.appendURLs(dst, line)
+		}
+		dst = p.appendURLs(dst, line[:start])
+		dst = p.appendURI(dst, line[start:end])
+		line = line[end:]
+	}
+}
+
+// appendURI appends converted uri, absolute urls are proxied and paths get proxy params, surrounding spaces are kept
+func (p *playlistRewriter) appendURI(dst, uri []byte) []byte {
+	start := len(uri) - len(bytes.TrimLeft(uri, " \t"))
+	end := len(bytes.TrimRight(uri, " \t"))
+	if start >= end {
+		return append(dst, uri...)
+	}
+	dst = append(dst, uri[:start]...)
+
+	// whole absolute uri is converted, trailing punctuation like = of base64 tokens is part of it
+	value := string(uri[start:end])
+	if isHTTPURL(uri[start:end]) {
+		dst = p.appendURL(dst, value)
+	} else if proxyPath, err := p.converter.ConvertPath(value, p.encURL); err == nil {
+		dst = append(dst, proxyPath...)
+	} else {
+		// not a path, urls inside are still converted
+		logger.Debug("Unable to convert uri path: " + value)
+		dst = p.appendURLs(dst, uri[start:end])
+	}
+
+	return append(dst, uri[end:]...)
+}
+
+// appendURLs appends text with all http urls converted to proxy ones
+func (p *playlistRewriter) appendURLs(dst, text []byte) []byte {
+	for {
+		start, end := findURL(text)
+		if start < 0 {
+			return append(dst, text...)
+		}
+		dst = append(dst, text[:start]...)
+		dst = p.appendURL(dst, string(text[start:end]))
+		text = text[end:]
+	}
+}
+
+// appendURL appends proxy url of real url, unconvertable url is kept unchanged
+func (p *playlistRewriter) appendURL(dst []byte, realURL string) []byte {
+	proxyURL, err := p.converter.Convert(realURL)
+	if err != nil {
+		logger.Warn("Unable to convert url: " + realURL)
+		return append(dst, realURL...)
+	}
+	return append(dst, proxyURL...)
+}
+
+// findURIAttribute returns span of first quoted URI attribute value, -1 if there is none
+func findURIAttribute(line []byte) (int, int) {
+	start := -1
+	for _, attr := range uriAttributes {
+		if i := bytes.Index(line, attr); i >= 0 && (start < 0 || i+len(attr) < start) {
+			start = i + len(attr)
+		}
+	}
+	if start < 0 {
+		return -1, -1
+	}
+	end := bytes.IndexByte(line[start:], '"')
+	if end < 0 {
+		return -1, -1
+	}
+	return start, start + end
+}
+
+// findURL returns span of first http or https url in text, -1 if there is none.
+// Url starts at word boundary, ends before space, quote, comma, parenthesis or angle bracket
+// and trailing punctuation other than slash isn't part of it.
+func findURL(text []byte) (int, int) {
+	offset := 0
+	for {
+		i := bytes.Index(text[offset:], httpPrefix)
+		if i < 0 {
+			return -1, -1
+		}
+		start := offset + i
+		offset = start + len(httpPrefix)
+
+		if start > 0 && isWordByte(text[start-1]) {
+			continue
+		}
+		rest := text[offset:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("://")):
+			offset += 3
+		case bytes.HasPrefix(rest, []byte("s://")):
+			offset += 4
+		default:
+			continue
+		}
+
+		end := offset
+		for end < len(text) && !isURLDelimiter(text[end]) {
+			end++
+		}
+		for end > offset && isPunct(text[end-1]) && text[end-1] != '/' {
+			end--
+		}
+		if end > offset {
+			return start, end
+		}
+	}
+}
+
+// isHTTPURL reports if text starts with http:// or https://
+func isHTTPURL(text []byte) bool {
+	return bytes.HasPrefix(text, []byte("http://")) || bytes.HasPrefix(text, []byte("https://"))
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+func isURLDelimiter(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r', '\v', '\f', ',', '(', ')', '<', '>', '"', '\'':
+		return true
+	}
+	return false
+}
+
+func isPunct(b byte) bool {
+	return '!' <= b && b <= '/' || ':' <= b && b <= '@' || '[' <= b && b <= '`' || '{' <= b && b <= '~'
+}
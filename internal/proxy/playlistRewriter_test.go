@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/urlconvert"
+)
+
+const (
+	testList   = "test"
+	testToken  = "token"
+	testKey    = "test_key"
+	testAppURL = "http://proxy.test"
+)
+
+var proxyTarget = regexp.MustCompile(`iptv_proxy_target=([A-Za-z0-9_=-]+)`)
+
+func TestMain(m *testing.M) {
+	os.Setenv("LIST_"+testList, "http://provider.test/list.m3u")
+	os.Setenv("TOKEN_"+testList, testToken)
+	config.Set("app.url", testAppURL)
+	config.Set("app.encryptionKey", testKey)
+	os.Exit(m.Run())
+}
+
+// rewriteString rewrites body of list, relative paths get target of base
+func rewriteString(t testing.TB, body, base string) string {
+	t.Helper()
+	encURL, err := urlconvert.EncodeTarget(base, testList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := rewriteBody(context.Background(), strings.NewReader(body), &out, testList, encURL); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// decodeTargets replaces encrypted targets of proxy urls by {decoded target}, so outputs can be compared
+func decodeTargets(t testing.TB, text string) string {
+	t.Helper()
+	return proxyTarget.ReplaceAllStringFunc(text, func(param string) string {
+		encoded := proxyTarget.FindStringSubmatch(param)[1]
+		target, err := urlconvert.Decode(encoded, testKey+testToken)
+		if err != nil {
+			t.Errorf("Invalid target %s: %v", encoded, err)
+			return param
+		}
+		return "iptv_proxy_target={" + target + "}"
+	})
+}
+
+func TestRewriteURIWithTrailingPunctuation(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{
+			name: "base64 token",
+			uri:  "http://provider.test/live/1.ts?token=YWJj==",
+			want: testAppURL + "/live/1.ts?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}&token=YWJj==",
+		},
+		{
+			name: "base64 token with padding only",
+			uri:  "https://provider.test:8443/hls/index.m3u8?t=YQ=",
+			want: testAppURL + "/hls/index.m3u8?iptv_proxy_list=test&iptv_proxy_target={https://provider.test:8443}&t=YQ=",
+		},
+		{
+			name: "trailing dot",
+			uri:  "http://provider.test/live/stream.",
+			want: testAppURL + "/live/stream.?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := rewriteString(t, "#EXTM3U\n#EXTINF:-1,Channel\n"+tt.uri+"\n", "http://provider.test")
+			want := "#EXTM3U\n#EXTINF:-1,Channel\n" + tt.want + "\n"
+			if got := decodeTargets(t, out); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+			if strings.Contains(out, "provider.test") {
+				t.Errorf("provider url leaked to client: %s", out)
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	longTitle := strings.Repeat("x", 3*rewriteBufferSize)
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "uri attributes",
+			body: "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+				"#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.test/key?id=1\",IV=0x1\n" +
+				"#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4,\nseg/1.ts\n",
+			want: "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" +
+				"#EXT-X-KEY:METHOD=AES-128,URI=\"http://proxy.test/key?id=1&iptv_proxy_list=test&iptv_proxy_target={https://keys.test}\",IV=0x1\n" +
+				"#EXT-X-MAP:URI=\"init.mp4?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\"\n" +
+				"#EXTINF:4,\nseg/1.ts?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n",
+		},
+		{
+			name: "relative paths",
+			body: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n/hls/low.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2\n../high.m3u8?q=1\n",
+			want: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n/hls/low.m3u8?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=2\n../high.m3u8?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}&q=1\n",
+		},
+		{
+			name: "multiple urls per line",
+			body: "#EXTM3U\n#EXTINF:-1 tvg-logo=\"http://logos.test/1.png\" url-tvg=\"https://epg.test/e.xml\",Name\nhttp://provider.test/1.ts\n",
+			want: "#EXTM3U\n#EXTINF:-1 tvg-logo=\"http://proxy.test/1.png?iptv_proxy_list=test&iptv_proxy_target={http://logos.test}\" " +
+				"url-tvg=\"http://proxy.test/e.xml?iptv_proxy_list=test&iptv_proxy_target={https://epg.test}\",Name\n" +
+				"http://proxy.test/1.ts?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n",
+		},
+		{
+			name: "urls in text",
+			body: "see http://a.test/1, (https://b.test/2) and http://c.test/3.\nxhttp://d.test/4 http:/e.test\n",
+			want: "see http://proxy.test/1?iptv_proxy_list=test&iptv_proxy_target={http://a.test}, " +
+				"(http://proxy.test/2?iptv_proxy_list=test&iptv_proxy_target={https://b.test}) and " +
+				"http://proxy.test/3?iptv_proxy_list=test&iptv_proxy_target={http://c.test}.\nxhttp://d.test/4 http:/e.test\n",
+		},
+		{
+			name: "crlf lines",
+			body: "#EXTM3U\r\n#EXTINF:-1,A\r\nhttp://provider.test/1.ts\r\n",
+			want: "#EXTM3U\n#EXTINF:-1,A\nhttp://proxy.test/1.ts?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n",
+		},
+		{
+			name: "missing new line at end",
+			body: "#EXTM3U\nhttp://provider.test/1.ts",
+			want: "#EXTM3U\nhttp://proxy.test/1.ts?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n",
+		},
+		{
+			name: "very long line",
+			body: "#EXTM3U\n#EXTINF:-1 tvg-logo=\"http://logos.test/1.png\"," + longTitle + " http://provider.test/x\nhttp://provider.test/1.ts\n",
+			want: "#EXTM3U\n#EXTINF:-1 tvg-logo=\"http://proxy.test/1.png?iptv_proxy_list=test&iptv_proxy_target={http://logos.test}\"," + longTitle +
+				" http://proxy.test/x?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n" +
+				"http://proxy.test/1.ts?iptv_proxy_list=test&iptv_proxy_target={http://provider.test}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeTargets(t, rewriteString(t, tt.body, "http://provider.test"))
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterSegments(t *testing.T) {
+	body := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg/1.ts\n" +
+		"#EXTINF:4,\n#EXT-X-BYTERANGE:1000@0\nall.ts\n#EXTINF:4,\n#EXT-X-BYTERANGE:1000\nall.ts\n#EXTINF:4,\nseg/2.ts\n"
+	p, err := newPlaylistRewriter(testList, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.baseURL, _ = url.Parse("http://provider.test/hls/index.m3u8")
+	p.segments = &segmentCache{known: make(map[string]knownSegment)}
+	p.segments.register("http://provider.test/hls/all.ts", time.Minute)
+	if err := p.rewrite(context.Background(), strings.NewReader(body), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{
+		"http://provider.test/hls/seg/1.ts": true,
+		"http://provider.test/hls/seg/2.ts": true,
+		"http://provider.test/hls/all.ts":   false,
+	} {
+		if _, ok := p.segments.ttl(key); ok != want {
+			t.Errorf("%s registered %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestStreamBoundToTarget(t *testing.T) {
+	body := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg/1.ts\n#EXTINF:4,\nhttp://cdn.test/seg/2.ts\n"
+	encURL, err := urlconvert.EncodeTarget("http://provider.test", testList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPlaylistRewriter(testList, encURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.baseURL, _ = url.Parse("http://provider.test/hls/index.m3u8")
+	p.stream = "lineage"
+	var out strings.Builder
+	if err := p.rewrite(context.Background(), strings.NewReader(body), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	tests := []struct {
+		name   string
+		url    string
+		stream string
+	}{
+		{name: "relative path", url: testAppURL + "/hls/" + lines[3], stream: "lineage"},
+		{name: "absolute url", url: lines[5], stream: "lineage"},
+		{name: "other path with the same target", url: strings.Replace(lines[5], "/seg/2.ts", "/live/other.ts", 1)},
+		{name: "target without lineage", url: testAppURL + "/seg/3.ts?iptv_proxy_list=test&iptv_proxy_target=" + encURL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if got := urlconvert.StreamOfRequest(r); got != tt.stream {
+				t.Errorf("got stream %q, want %q", got, tt.stream)
+			}
+		})
+	}
+}
+
+// benchmarkPlaylistSize is size of generated playlist, big providers serve lists of tens of megabytes
+const benchmarkPlaylistSize = 50 << 20
+
+func generatePlaylist(size int) []byte {
+	var b strings.Builder
+	b.Grow(size + 512)
+	b.WriteString("#EXTM3U url-tvg=\"http://epg.test/epg.xml.gz\"\n")
+	for i := 0; b.Len() < size; i++ {
+		n := strconv.Itoa(i)
+		b.WriteString("#EXTINF:-1 tvg-id=\"channel" + n + "\" tvg-name=\"Channel " + n + "\" tvg-logo=\"http://logos.test/" + n +
+			".png\" group-title=\"Group " + strconv.Itoa(i%50) + "\",Channel " + n + "\n")
+		b.WriteString("http://provider.test:8080/live/user/password/" + n + ".ts\n")
+	}
+	return []byte(b.String())
+}
+
+func BenchmarkRewrite(b *testing.B) {
+	playlist := generatePlaylist(benchmarkPlaylistSize)
+	encURL, err := urlconvert.EncodeTarget("http://provider.test", testList)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(playlist)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rewriteBody(context.Background(), bytes.NewReader(playlist), io.Discard, testList, encURL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+const (
+	// probeHeadSize is read from start of stream, it is enough to find three packets after sync byte
+	probeHeadSize = 4 * tsPacketSize
+	// maxProbeFetches limits playlists followed to segment of HLS channel
+	maxProbeFetches = 4
+	// probeSchedulerInterval is how often config is checked for lists enabling probes
+	probeSchedulerInterval = 30 * time.Second
+	// probeSlotRetryDelay is wait before probe tries again to find free connection slot of list
+	probeSlotRetryDelay = 5 * time.Second
+	defaultOfflineGroup = "Offline"
+)
+
+// Statuses of probed channel
+const (
+	channelAlive   = "alive"
+	channelDead    = "dead"
+	channelUnknown = "unknown"
+)
+
+// probeResult is result of one probe of channel, latency is time until its first bytes were checked
+type probeResult struct {
+	Time    time.Time `json:"time"`
+	Alive   bool      `json:"alive"`
+	Latency int64     `json:"latencyMs"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// prober checks channels of lists in background, results are kept by real stream url of channel
+type prober struct {
+	mu      sync.Mutex
+	history map[string]map[string][]probeResult
+	running map[string]bool
+}
+
+var probes = &prober{history: make(map[string]map[string][]probeResult), running: make(map[string]bool)}
+
+// deadChannelFilter hides dead channels of rewritten playlist or moves them to offline group
+type deadChannelFilter struct {
+	urls  map[string]bool
+	hide  bool
+	group string
+}
+
+// StartProbes probes lists which enable it until server stops, lists enabled by config reload are picked up
+func StartProbes() {
+	ctx, cancel := context.WithCancel(context.Background())
+	OnShutdown(cancel)
+	go probes.schedule(ctx)
+}
+
+func (pr *prober) schedule(ctx context.Context) {
+	ticker := time.NewTicker(probeSchedulerInterval)
+	defer ticker.Stop()
+	for {
+		for name, list := range config.GetConfig().Lists {
+			if list.Probe.Enabled {
+				pr.start(ctx, name)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pr *prober) start(ctx context.Context, listName string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.running[listName] {
+		return
+	}
+	pr.running[listName] = true
+	go pr.run(ctx, listName)
+}
+
+// run probes channels of list every interval until probing of list is disabled, its results are dropped then
+func (pr *prober) run(ctx context.Context, listName string) {
+	defer func() {
+		pr.mu.Lock()
+		delete(pr.running, listName)
+		delete(pr.history, listName)
+		pr.mu.Unlock()
+	}()
+
+	for {
+		list, err := config.GetListFromConfig(listName)
+		if err != nil || !list.Probe.Enabled {
+			return
+		}
+		pr.probeList(ctx, listName)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.GetConfig().Server.Probe.Interval):
+		}
+	}
+}
+
+// probeList probes each stream of list once, probe runs only when list has free connection slot
+func (pr *prober) probeList(ctx context.Context, listName string) {
+	channels, err := getChannels(ctx, listName)
+	if err != nil {
+		logger.Warn("Unable to probe channels of list " + listName + ": " + err.Error())
+		return
+	}
+	client, err := GetListClient(listName)
+	if err != nil {
+		logger.Warn("Unable to probe channels of list " + listName + ": " + err.Error())
+		return
+	}
+	// live streams are only started, probe is limited by timeout of its context
+	probeClient := *client
+	probeClient.Timeout = 0
+	c := config.GetConfig().Server.Probe
+
+	started := time.Now()
+	slots := make(chan struct{}, c.Slots)
+	var wg sync.WaitGroup
+	var deadMu sync.Mutex
+	dead := 0
+	seen := make(map[string]bool, len(channels))
+	for _, ch := range channels {
+		if seen[ch.URL] {
+			continue
+		}
+		seen[ch.URL] = true
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		// viewer waiting for slot of full list stops the probe
+		probeCtx, stop := context.WithCancel(ctx)
+		release, ok := tryLockListConnection(listName, stop)
+		for !ok {
+			select {
+			case <-time.After(probeSlotRetryDelay):
+			case <-ctx.Done():
+				stop()
+				wg.Wait()
+				return
+			}
+			release, ok = tryLockListConnection(listName, stop)
+		}
+
+		wg.Add(1)
+		go func(streamURL string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer release()
+			defer stop()
+			result := probeStream(probeCtx, &probeClient, listName, streamURL, c.Timeout)
+			if probeCtx.Err() != nil {
+				// stopped probe keeps the last result of channel
+				if ctx.Err() == nil {
+					logger.Debug("Probe of " + streamURL + " of list " + listName + " stopped for viewer")
+				}
+				return
+			}
+			pr.record(listName, streamURL, result, c.History)
+			if !result.Alive {
+				deadMu.Lock()
+				dead++
+				deadMu.Unlock()
+			}
+		}(ch.URL)
+	}
+	wg.Wait()
+
+	pr.mu.Lock()
+	for streamURL := range pr.history[listName] {
+		if !seen[streamURL] {
+			delete(pr.history[listName], streamURL)
+		}
+	}
+	pr.mu.Unlock()
+	logger.Info("Probed " + strconv.Itoa(len(seen)) + " channels of list " + listName + " in " +
+		time.Since(started).Round(time.Second).String() + ", dead: " + strconv.Itoa(dead))
+}
+
+func (pr *prober) record(listName, streamURL string, result probeResult, size int) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	h, ok := pr.history[listName]
+	if !ok {
+		h = make(map[string][]probeResult)
+		pr.history[listName] = h
+	}
+	results := append(h[streamURL], result)
+	if len(results) > size {
+		results = append([]probeResult(nil), results[len(results)-size:]...)
+	}
+	h[streamURL] = results
+	if !result.Alive {
+		logger.Debug("Probe of " + streamURL + " of list " + listName + " failed: " + result.Error)
+	}
+}
+
+// results returns probe history of stream, the newest result is the last one
+func (pr *prober) results(listName, streamURL string) []probeResult {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return append([]probeResult(nil), pr.history[listName][streamURL]...)
+}
+
+// newDeadChannelFilter returns filter of streams of list which failed their last probe, nil when there is nothing to filter
+func newDeadChannelFilter(listName string) *deadChannelFilter {
+	list, err := config.GetListFromConfig(listName)
+	if err != nil || !list.Probe.Enabled || (list.Probe.DeadChannels != "hide" && list.Probe.DeadChannels != "offline") {
+		return nil
+	}
+
+	f := &deadChannelFilter{urls: make(map[string]bool), hide: list.Probe.DeadChannels == "hide", group: list.Probe.OfflineGroup}
+	if f.group == "" {
+		f.group = defaultOfflineGroup
+	}
+	probes.mu.Lock()
+	for streamURL, results := range probes.history[listName] {
+		if len(results) > 0 && !results[len(results)-1].Alive {
+			f.urls[streamURL] = true
+		}
+	}
+	probes.mu.Unlock()
+	if len(f.urls) == 0 {
+		return nil
+	}
+	return f
+}
+
+// probeStream requests stream and checks its first bytes within timeout
+func probeStream(ctx context.Context, client *http.Client, listName, streamURL string, timeout time.Duration) probeResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := probeResult{Time: time.Now()}
+	err := checkStream(ctx, client, listName, streamURL)
+	result.Latency = time.Since(result.Time).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Alive = true
+	}
+	return result
+}
+
+// checkStream checks that stream responds with MPEG-TS, HLS playlists are followed to their last segment
+func checkStream(ctx context.Context, client *http.Client, listName, streamURL string) error {
+	next, encrypted := streamURL, false
+	for fetch := 0; fetch < maxProbeFetches; fetch++ {
+		resp, err := getFollowingRedirects(ctx, client, next, listName)
+		if err != nil {
+			return err
+		}
+		next, encrypted, err = checkProbeResponse(resp, encrypted)
+		resp.Body.Close()
+		if err != nil || next == "" {
+			return err
+		}
+	}
+	return errors.New("Too many nested playlists")
+}
+
+// checkProbeResponse checks first bytes of response, for HLS playlist url of the next playlist or segment is returned.
+// Body of encrypted segment can't be checked, so any body is accepted.
+func checkProbeResponse(resp *http.Response, encrypted bool) (string, bool, error) {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", false, errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return "", false, err
+	}
+	br := bufio.NewReaderSize(resp.Body, probeHeadSize)
+	head, err := br.Peek(probeHeadSize)
+	if len(head) == 0 {
+		if err == nil || err == io.EOF {
+			err = errors.New("Empty response")
+		}
+		return "", false, err
+	}
+	if encrypted || hasTSSync(head) {
+		return "", false, nil
+	}
+
+	kind, _ := sniffContent(head)
+	switch kind {
+	case "m3u":
+		pl, err := parseHLSPlaylist(br, resp.Request.URL.String())
+		if err != nil {
+			return "", false, err
+		}
+		if len(pl.variants) > 0 {
+			v, err := selectVariant(pl.variants, "lowest")
+			return v.url, false, err
+		}
+		if len(pl.segments) == 0 {
+			return "", false, errors.New("Media playlist has no segments")
+		}
+		seg := pl.segments[len(pl.segments)-1]
+		return seg.url, seg.key.method != "", nil
+	case "mp4", "adts", "id3":
+		// segments of HLS channels can be fragmented mp4 or packed audio
+		return "", false, nil
+	}
+	return "", false, errors.New("Stream is not MPEG-TS but " + kind)
+}
+
+// hasTSSync checks sync byte at start of three consecutive packets, stream doesn't have to start at packet boundary
+func hasTSSync(head []byte) bool {
+	for offset := 0; offset < tsPacketSize && offset+2*tsPacketSize < len(head); offset++ {
+		if isMPEGTS(head[offset:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelStatus returns status of stream by its last probe
+func channelStatus(results []probeResult) string {
+	switch {
+	case len(results) == 0:
+		return channelUnknown
+	case results[len(results)-1].Alive:
+		return channelAlive
+	}
+	return channelDead
+}
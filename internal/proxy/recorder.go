@@ -0,0 +1,552 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+)
+
+const (
+	recordingsFile = "recordings.json"
+	// recordingSegmentDuration is duration of byte range segments of recording playlist
+	recordingSegmentDuration = 6 * time.Second
+	maxRecordingDuration     = 24 * time.Hour
+	// recordingSaveInterval is how often index of running recording is saved, longer part is lost when proxy is killed
+	recordingSaveInterval = 30 * time.Second
+	// recordingStallFactor is number of segment durations without data after which attempt is retried
+	recordingStallFactor = 5
+)
+
+// Statuses of recording
+const (
+	recordingScheduled = "scheduled"
+	recordingActive    = "recording"
+	recordingCompleted = "completed"
+	recordingFailed    = "failed"
+)
+
+var errRecordingNotFound = errors.New("Recording not found")
+
+// recording is recording of channel between start and stop, it is written to one TS file
+type recording struct {
+	ID        string    `json:"id"`
+	List      string    `json:"list"`
+	Channel   string    `json:"channel"`
+	Programme string    `json:"programme,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	// Segments are byte ranges of file listed in playlist of recording
+	Segments []recordedSegment `json:"segments,omitempty"`
+}
+
+type recordedSegment struct {
+	Offset        int64         `json:"offset"`
+	Size          int64         `json:"size"`
+	Duration      time.Duration `json:"duration"`
+	Discontinuity bool          `json:"discontinuity,omitempty"`
+}
+
+// recorder schedules recordings and keeps them in recordings.json of server.recordings.dir
+type recorder struct {
+	dir     string
+	saveMu  sync.Mutex
+	mu      sync.Mutex
+	items   map[string]*recording
+	running map[string]*recordingRun
+	wg      sync.WaitGroup
+}
+
+// recordingRun is goroutine of scheduled recording, done is closed when it exits
+type recordingRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var recordings *recorder
+
+// StartRecordings loads saved recordings and schedules unfinished ones, it does nothing when recordings are disabled
+func StartRecordings() error {
+	dir := config.GetConfig().Server.Recordings.Dir
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	m := &recorder{dir: dir, items: make(map[string]*recording), running: make(map[string]*recordingRun)}
+	data, err := os.ReadFile(filepath.Join(dir, recordingsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		saved := []*recording{}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return errors.New("Unable to read " + recordingsFile + ": " + err.Error())
+		}
+		for _, rec := range saved {
+			m.items[rec.ID] = rec
+		}
+	}
+
+	now := time.Now()
+	for _, rec := range m.items {
+		switch {
+		case rec.Status != recordingScheduled && rec.Status != recordingActive:
+		case rec.Stop.After(now):
+			m.schedule(rec)
+		case rec.Size > 0:
+			rec.Status = recordingCompleted
+		default:
+			rec.Status = recordingFailed
+			rec.Error = "Proxy wasn't running"
+		}
+	}
+	m.save()
+	recordings = m
+	OnShutdown(m.shutdown)
+	logger.Info("Recordings loaded: " + strconv.Itoa(len(m.items)))
+
+	return nil
+}
+
+// create validates and schedules new recording
+func (m *recorder) create(listName string, ch channel, start, stop time.Time) (recording, error) {
+	if !stop.After(start) {
+		return recording{}, errors.New("Stop must be after start")
+	}
+	if !stop.After(time.Now()) {
+		return recording{}, errors.New("Stop is in the past")
+	}
+	if stop.Sub(start) > maxRecordingDuration {
+		return recording{}, errors.New("Recording can't be longer than " + maxRecordingDuration.String())
+	}
+	id, err := newRecordingID()
+	if err != nil {
+		return recording{}, err
+	}
+
+	rec := &recording{ID: id, List: listName, Channel: ch.ID, Start: start, Stop: stop, Status: recordingScheduled}
+	name := start.Local().Format("20060102-1504") + "_" + ch.ID + "_" + id + ".ts"
+	rec.File = filepath.Join(safeFileName(listName), safeFileName(name))
+
+	m.mu.Lock()
+	m.items[id] = rec
+	// recording which should already run changes its status as soon as it is scheduled
+	created := m.view(rec)
+	m.mu.Unlock()
+	m.schedule(rec)
+	m.save()
+	logger.Info("Recording scheduled: " + id + " " + listName + "|" + ch.ID + " " + start.Format(time.RFC3339) + " - " + stop.Format(time.RFC3339))
+
+	return created, nil
+}
+
+// setProgramme adds programme details to recording
+func (m *recorder) setProgramme(id string, p programme) {
+	m.mu.Lock()
+	if rec, ok := m.items[id]; ok {
+		rec.Programme = p.ID
+		rec.Title = p.Title
+	}
+	m.mu.Unlock()
+	m.save()
+}
+
+// get returns copy of recording without segments
+func (m *recorder) get(listName, id string) (recording, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.items[id]
+	if !ok || rec.List != listName {
+		return recording{}, errRecordingNotFound
+	}
+	return m.view(rec), nil
+}
+
+// list returns recordings of list sorted by start
+func (m *recorder) list(listName string) []recording {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []recording{}
+	for _, rec := range m.items {
+		if rec.List == listName {
+			list = append(list, m.view(rec))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// segments returns copy of recording with its segments
+func (m *recorder) segments(listName, id string) (recording, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.items[id]
+	if !ok || rec.List != listName {
+		return recording{}, errRecordingNotFound
+	}
+	r := *rec
+	r.Segments = append([]recordedSegment(nil), rec.Segments...)
+	return r, nil
+}
+
+// remove cancels recording and removes its file once recording goroutine exited, so retry can't create it again
+func (m *recorder) remove(listName, id string) error {
+	m.mu.Lock()
+	rec, ok := m.items[id]
+	if !ok || rec.List != listName {
+		m.mu.Unlock()
+		return errRecordingNotFound
+	}
+	run := m.running[id]
+	delete(m.items, id)
+	m.mu.Unlock()
+
+	if run != nil {
+		run.cancel()
+		<-run.done
+	}
+	if err := os.Remove(m.path(rec)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("Unable to remove recording " + id + ": " + err.Error())
+	}
+	m.save()
+	logger.Info("Recording removed: " + id)
+	return nil
+}
+
+func (m *recorder) view(rec *recording) recording {
+	r := *rec
+	r.Segments = nil
+	return r
+}
+
+func (m *recorder) path(rec *recording) string {
+	return filepath.Join(m.dir, rec.File)
+}
+
+func (m *recorder) schedule(rec *recording) {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &recordingRun{cancel: cancel, done: make(chan struct{})}
+	m.mu.Lock()
+	m.running[rec.ID] = run
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(run.done)
+		defer func() {
+			m.mu.Lock()
+			if m.running[rec.ID] == run {
+				delete(m.running, rec.ID)
+			}
+			m.mu.Unlock()
+			cancel()
+		}()
+		m.run(ctx, rec)
+	}()
+}
+
+// run waits for start of recording and records it, failed attempts are retried until stop
+func (m *recorder) run(ctx context.Context, rec *recording) {
+	m.mu.Lock()
+	start, stop := rec.Start, rec.Stop
+	m.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(start)):
+	}
+
+	m.setStatus(rec, recordingActive, "")
+	logger.Info("Recording started: " + rec.ID)
+	for {
+		err := m.record(ctx, rec)
+		if ctx.Err() != nil {
+			// removed or proxy is stopping, state is kept so recording resumes after restart
+			return
+		}
+		if err == nil || !time.Now().Before(stop) {
+			m.setStatus(rec, recordingCompleted, "")
+			logger.Info("Recording completed: " + rec.ID)
+			return
+		}
+
+		c := config.GetConfig().Server.Recordings
+		m.mu.Lock()
+		rec.Attempts++
+		attempts := rec.Attempts
+		m.mu.Unlock()
+		if attempts > c.Retries {
+			m.setStatus(rec, recordingFailed, err.Error())
+			logger.Warn("Recording failed: " + rec.ID + ": " + err.Error())
+			return
+		}
+		m.setStatus(rec, recordingActive, err.Error())
+		logger.Warn("Recording " + rec.ID + " interrupted (" + err.Error() + "), retrying in " + c.RetryDelay.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.RetryDelay):
+		}
+	}
+}
+
+// record appends stream of channel to recording file until stop, it returns nil when stop was reached.
+// MPEG-TS channels are recorded as they are, HLS channels are remuxed to MPEG-TS.
+func (m *recorder) record(ctx context.Context, rec *recording) error {
+	m.mu.Lock()
+	listName, channelID, stop := rec.List, rec.Channel, rec.Stop
+	resumed := len(rec.Segments) > 0
+	m.mu.Unlock()
+
+	// playlist of list is fetched on its own connection slot, so channel is looked up first
+	ch, err := getChannel(ctx, listName, channelID)
+	if err != nil {
+		return err
+	}
+	releaseConnection, err := lockListConnection(listName)
+	if err != nil {
+		return errors.New("Too many connections for list " + listName)
+	}
+	defer releaseConnection()
+
+	client, err := GetListClient(listName)
+	if err != nil {
+		return err
+	}
+	streamClient := *client
+	streamClient.Timeout = 0
+
+	recCtx, cancel := context.WithDeadline(ctx, stop)
+	defer cancel()
+	// stream client has no timeout, attempt is canceled when provider stops sending data
+	attemptCtx, cancelAttempt := context.WithCancel(recCtx)
+	defer cancelAttempt()
+	stallTimeout := recordingStallFactor * recordingSegmentDuration
+	var stalled int32
+	idle := time.AfterFunc(stallTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		cancelAttempt()
+	})
+	defer idle.Stop()
+	resp, err := getFollowingRedirects(attemptCtx, &streamClient, ch.URL, listName)
+	if err != nil {
+		return stallError(recCtx, err, &stalled, stallTimeout)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(resp.Body, sniffSize)
+	head, _ := br.Peek(sniffSize)
+	kind, _ := sniffContent(head)
+	if kind != "mpegts" && kind != "m3u" {
+		return fmt.Errorf("%w but %s", errNotMPEGTS, kind)
+	}
+
+	f, offset, err := m.openFile(rec)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var writeErr error
+	lastSave := time.Now()
+	segmenter := mpegts.NewSegmenter(recordingSegmentDuration, func(seg mpegts.Segment) {
+		if writeErr != nil {
+			return
+		}
+		if _, writeErr = f.Write(seg.Data); writeErr != nil {
+			return
+		}
+		size := int64(len(seg.Data))
+		m.mu.Lock()
+		rec.Segments = append(rec.Segments, recordedSegment{Offset: offset, Size: size, Duration: seg.Duration, Discontinuity: seg.Discontinuity})
+		rec.Size = offset + size
+		m.mu.Unlock()
+		offset += size
+		if time.Since(lastSave) >= recordingSaveInterval {
+			m.save()
+			lastSave = time.Now()
+		}
+	})
+	if resumed {
+		// time base of reopened stream differs from previous attempt
+		segmenter.Discontinue()
+	}
+	w := writerFunc(func(p []byte) (int, error) {
+		idle.Reset(stallTimeout)
+		segmenter.Write(p)
+		return len(p), writeErr
+	})
+
+	if kind == "m3u" {
+		resp.Body.Close()
+		rm := newHLSRemuxer(listName, client, w, nil)
+		err = rm.run(attemptCtx, resp.Request.URL.String(), "")
+	} else {
+		_, err = io.Copy(w, br)
+	}
+	// the last partial segment is kept
+	segmenter.Discontinue()
+	if writeErr != nil {
+		return writeErr
+	}
+	if err == nil {
+		err = errors.New("Stream ended")
+	}
+	return stallError(recCtx, err, &stalled, stallTimeout)
+}
+
+// stallError returns error of attempt which was canceled because stream stalled, nil when stop time was reached
+func stallError(recCtx context.Context, err error, stalled *int32, stallTimeout time.Duration) error {
+	if atomic.LoadInt32(stalled) == 1 && recCtx.Err() == nil {
+		return errors.New("No data received in " + stallTimeout.String())
+	}
+	return stopError(recCtx, err)
+}
+
+// openFile opens recording file for writing after its indexed segments. Bytes written after the index
+// was saved last time, e.g. before proxy was killed, are cut off, so new segments follow indexed ones.
+func (m *recorder) openFile(rec *recording) (*os.File, int64, error) {
+	path := m.path(rec)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	m.mu.Lock()
+	// segments missing in shorter file are dropped
+	for len(rec.Segments) > 0 {
+		last := rec.Segments[len(rec.Segments)-1]
+		if last.Offset+last.Size <= info.Size() {
+			break
+		}
+		rec.Segments = rec.Segments[:len(rec.Segments)-1]
+	}
+	offset := int64(0)
+	if n := len(rec.Segments); n > 0 {
+		offset = rec.Segments[n-1].Offset + rec.Segments[n-1].Size
+	}
+	rec.Size = offset
+	m.mu.Unlock()
+
+	if offset < info.Size() {
+		logger.Warn("Recording " + rec.ID + " has " + strconv.FormatInt(info.Size()-offset, 10) + " bytes not indexed, cutting them off")
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, offset, nil
+}
+
+// stopError returns nil when recording ended because its stop time was reached
+func stopError(recCtx context.Context, err error) error {
+	if errors.Is(recCtx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+func (m *recorder) setStatus(rec *recording, status, errMessage string) {
+	m.mu.Lock()
+	rec.Status = status
+	rec.Error = errMessage
+	m.mu.Unlock()
+	m.save()
+}
+
+// save writes recordings to recordings.json, file is replaced at once so it is never left half written
+func (m *recorder) save() {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	m.mu.Lock()
+	list := make([]*recording, 0, len(m.items))
+	for _, rec := range m.items {
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		logger.Error("Unable to save recordings: " + err.Error())
+		return
+	}
+
+	path := filepath.Join(m.dir, recordingsFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		logger.Error("Unable to save recordings: " + err.Error())
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		logger.Error("Unable to save recordings: " + err.Error())
+	}
+}
+
+// shutdown stops running recordings and saves their state
+func (m *recorder) shutdown() {
+	m.mu.Lock()
+	for _, run := range m.running {
+		run.cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	m.save()
+	logger.Info("Recordings saved")
+}
+
+func newRecordingID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writerFunc is function implementing io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
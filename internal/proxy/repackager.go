@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+)
+
+const (
+	// repackageExtraSegments are kept after they leave playlist, so slower players can still fetch them
+	repackageExtraSegments = 3
+	repackageMaxBackoff    = 30 * time.Second
+)
+
+// repackager reads live MPEG-TS stream of channel through one list connection
+// and cuts it to segments served as HLS. It runs until nobody requests it for server.repackage.idleTimeout,
+// or server.dvr.idleTimeout when disk buffer of channel is used.
+type repackager struct {
+	key      string
+	listName string
+	channel  channel
+	store    segmentStore
+
+	// addMu serializes adding of segments to stores, so disk buffer created meanwhile gets every segment once.
+	// Disk is written holding only addMu, mu guards fields below and is never held during disk writes.
+	addMu sync.Mutex
+
+	mu         sync.Mutex
+	dvr        segmentStore
+	stopped    bool
+	lastAccess time.Time
+	ready      chan struct{}
+	readyOnce  sync.Once
+	cancel     context.CancelFunc
+	done       chan struct{}
+	err        error
+}
+
+var errNotMPEGTS = errors.New("Stream is not MPEG-TS")
+
+var repackagers = make(map[string]*repackager)
+var repackagersMu sync.Mutex
+var onceRepackagers sync.Once
+
+// getRepackager returns running repackager of channel, it is started on first request
+func getRepackager(listName string, ch channel) *repackager {
+	onceRepackagers.Do(func() {
+		OnShutdown(stopRepackagers)
+	})
+
+	key := listName + "|" + ch.ID
+	repackagersMu.Lock()
+	defer repackagersMu.Unlock()
+	if rp, ok := repackagers[key]; ok {
+		rp.touch()
+		return rp
+	}
+
+	c := config.GetConfig().Server.Repackage
+	ctx, cancel := context.WithCancel(context.Background())
+	rp := &repackager{
+		key:        key,
+		listName:   listName,
+		channel:    ch,
+		store:      newMemorySegmentStore(c.PlaylistSize + repackageExtraSegments),
+		lastAccess: time.Now(),
+		ready:      make(chan struct{}),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	repackagers[key] = rp
+	go rp.run(ctx, c.SegmentDuration)
+	go rp.stopWhenIdle(ctx)
+	logger.Info("Repackaging started: " + key)
+
+	return rp
+}
+
+// findRepackager returns repackager of channel only if it is running
+func findRepackager(listName, channelID string) (*repackager, bool) {
+	repackagersMu.Lock()
+	defer repackagersMu.Unlock()
+	rp, ok := repackagers[listName+"|"+channelID]
+	if ok {
+		rp.touch()
+	}
+	return rp, ok
+}
+
+func stopRepackagers() {
+	repackagersMu.Lock()
+	running := make([]*repackager, 0, len(repackagers))
+	for _, rp := range repackagers {
+		running = append(running, rp)
+	}
+	repackagersMu.Unlock()
+
+	for _, rp := range running {
+		rp.cancel()
+		<-rp.done
+	}
+}
+
+func (rp *repackager) touch() {
+	rp.mu.Lock()
+	rp.lastAccess = time.Now()
+	rp.mu.Unlock()
+}
+
+// waitReady waits until first segment is available, returns error when repackager stopped or wait timed out
+func (rp *repackager) waitReady(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-rp.ready:
+		return nil
+	case <-rp.done:
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		return rp.err
+	case <-timer.C:
+		return errors.New("No segment of " + rp.key + " in " + timeout.String())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rp *repackager) stopWhenIdle(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c := config.GetConfig().Server
+			timeout := c.Repackage.IdleTimeout
+			rp.mu.Lock()
+			idle := time.Since(rp.lastAccess)
+			if rp.dvr != nil && c.DVR.IdleTimeout > timeout {
+				timeout = c.DVR.IdleTimeout
+			}
+			rp.mu.Unlock()
+			if idle > timeout {
+				logger.Info("Repackaging idle: " + rp.key)
+				rp.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (rp *repackager) run(ctx context.Context, segmentDuration time.Duration) {
+	err := rp.repackage(ctx, segmentDuration)
+
+	repackagersMu.Lock()
+	if repackagers[rp.key] == rp {
+		delete(repackagers, rp.key)
+	}
+	repackagersMu.Unlock()
+
+	rp.cancel()
+	rp.store.close()
+	rp.mu.Lock()
+	rp.stopped = true
+	if rp.dvr != nil {
+		if err := rp.dvr.close(); err != nil {
+			logger.Warn("Unable to remove buffer of " + rp.key + ": " + err.Error())
+		}
+	}
+	rp.err = err
+	if rp.err == nil {
+		rp.err = errors.New("Repackaging of " + rp.key + " stopped")
+	}
+	rp.mu.Unlock()
+	close(rp.done)
+	logger.Info("Repackaging stopped: " + rp.key)
+}
+
+// dvrStore returns disk buffer of channel, it is created on first use with segments repackaged so far
+func (rp *repackager) dvrStore() (segmentStore, error) {
+	rp.mu.Lock()
+	dvr := rp.dvr
+	rp.mu.Unlock()
+	if dvr != nil {
+		return dvr, nil
+	}
+
+	rp.addMu.Lock()
+	defer rp.addMu.Unlock()
+	rp.mu.Lock()
+	dvr, stopped := rp.dvr, rp.stopped
+	rp.mu.Unlock()
+	if dvr != nil {
+		return dvr, nil
+	}
+	if stopped {
+		return nil, errors.New("Repackaging of " + rp.key + " stopped")
+	}
+
+	c := config.GetConfig().Server.DVR
+	dir := filepath.Join(c.Dir, safeFileName(rp.listName), safeFileName(rp.channel.ID))
+	disk, err := newDiskSegmentStore(dir, c.Duration, int64(c.MaxSize))
+	if err != nil {
+		return nil, err
+	}
+	segments, _ := rp.store.segments()
+	for _, info := range segments {
+		body, err := rp.store.open(info.seq)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			continue
+		}
+		if err := disk.add(mpegts.Segment{Data: data, Duration: info.duration, Discontinuity: info.discontinuity}); err != nil {
+			disk.close()
+			return nil, err
+		}
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.stopped {
+		// run removes buffer of stopped repackager only if it was set before
+		disk.close()
+		return nil, errors.New("Repackaging of " + rp.key + " stopped")
+	}
+	rp.dvr = disk
+	logger.Info("Buffering started: " + rp.key)
+
+	return disk, nil
+}
+
+// repackage holds list connection and reads stream, reconnecting with backoff until ctx is done
+func (rp *repackager) repackage(ctx context.Context, segmentDuration time.Duration) error {
+	releaseConnection, err := lockListConnection(rp.listName)
+	if err != nil {
+		logger.Warn("Too many connections for list " + rp.listName)
+		return err
+	}
+	defer releaseConnection()
+
+	segmenter := mpegts.NewSegmenter(segmentDuration, func(seg mpegts.Segment) {
+		rp.addMu.Lock()
+		defer rp.addMu.Unlock()
+		if err := rp.store.add(seg); err != nil {
+			logger.Error("Unable to store segment of " + rp.key + ": " + err.Error())
+			return
+		}
+		rp.readyOnce.Do(func() { close(rp.ready) })
+
+		rp.mu.Lock()
+		dvr := rp.dvr
+		rp.mu.Unlock()
+		if dvr != nil {
+			if err := dvr.add(seg); err != nil {
+				logger.Error("Unable to buffer segment of " + rp.key + ": " + err.Error())
+			}
+		}
+	})
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := rp.consume(ctx, segmenter)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errNotMPEGTS) {
+			// reconnecting won't help, channel is probably HLS or page
+			logger.Warn("Unable to repackage " + rp.key + ": " + err.Error())
+			return err
+		}
+		logger.Warn("Stream of " + rp.key + " interrupted (" + err.Error() + "), reconnecting in " + backoff.String())
+		segmenter.Discontinue()
+
+		if time.Since(started) > repackageMaxBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > repackageMaxBackoff {
+			backoff = repackageMaxBackoff
+		}
+	}
+}
+
+// consume copies upstream stream of channel to w until it ends or fails
+func (rp *repackager) consume(ctx context.Context, w io.Writer) error {
+	client, err := GetListClient(rp.listName)
+	if err != nil {
+		return err
+	}
+	// live stream is read as long as it is watched, client timeout would cut it
+	streamClient := *client
+	streamClient.Timeout = 0
+
+	resp, err := getFollowingRedirects(ctx, &streamClient, rp.channel.URL, rp.listName)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(resp.Body, sniffSize)
+	head, _ := br.Peek(sniffSize)
+	if kind, _ := sniffContent(head); kind != "mpegts" {
+		return fmt.Errorf("%w but %s", errNotMPEGTS, kind)
+	}
+
+	_, err = io.Copy(w, br)
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
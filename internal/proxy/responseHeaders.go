@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+)
+
+// rewrittenBodyHeaders describe original body and are invalid after it was rewritten
+var rewrittenBodyHeaders = [...]string{"Content-Length", "Content-Range", "Accept-Ranges", "Content-Encoding", "ETag", "Content-MD5", "Digest"}
+
+// copyResponseHeaders copies provider response headers allowed by list and server policy.
+// Hop-by-hop headers are always dropped, location is handled separately because it has to be converted.
+func copyResponseHeaders(dst, src http.Header, listName string, rewritten bool) {
+	policy := responseHeaderPolicy(listName)
+
+	// headers named in Connection header are hop-by-hop too
+	connectionHeaders := []string{}
+	for _, v := range src.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			connectionHeaders = append(connectionHeaders, strings.TrimSpace(name))
+		}
+	}
+
+	// proxy answers with its own CORS headers when list configures them
+	corsEnabled := isCORSEnabled(listName)
+
+	for name, values := range src {
+		if corsEnabled && matchHeader(name, []string{"Access-Control-*"}) {
+			continue
+		}
+		if strings.EqualFold(name, "Location") || config.IsHopByHopHeader(name) || matchHeader(name, connectionHeaders) {
+			continue
+		}
+		if rewritten && matchHeader(name, rewrittenBodyHeaders[:]) {
+			continue
+		}
+		if !matchHeader(name, policy.Allow) || matchHeader(name, policy.Deny) {
+			continue
+		}
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+}
+
+// responseHeaderPolicy merges policy of list over server one, allow of list replaces server allow when it is set
+// and headers denied by either of them are denied
+func responseHeaderPolicy(listName string) config.HeaderPolicy {
+	policy := config.GetConfig().Server.ResponseHeaders
+	list, err := config.GetListFromConfig(listName)
+	if err != nil {
+		return policy
+	}
+	if len(list.ResponseHeaders.Allow) > 0 {
+		policy.Allow = list.ResponseHeaders.Allow
+	}
+	if len(list.ResponseHeaders.Deny) > 0 {
+		policy.Deny = append(append([]string(nil), policy.Deny...), list.ResponseHeaders.Deny...)
+	}
+	return policy
+}
+
+// matchHeader reports if header name matches one of patterns, pattern ending with * matches prefix
+func matchHeader(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == "*" {
+			return true
+		}
+		if strings.HasSuffix(p, "*") {
+			prefix := p[:len(p)-1]
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// lengthBufferWriter holds rewritten body up to limit so Content-Length can be set,
+// bigger bodies are streamed without it.
+type lengthBufferWriter struct {
+	w         http.ResponseWriter
+	status    int
+	limit     int
+	buf       bytes.Buffer
+	streaming bool
+}
+
+func newLengthBufferWriter(w http.ResponseWriter, status int) *lengthBufferWriter {
+	return &lengthBufferWriter{w: w, status: status, limit: int(config.GetConfig().Server.RewriteBufferSize)}
+}
+
+func (b *lengthBufferWriter) Write(p []byte) (int, error) {
+	if b.streaming {
+		return b.w.Write(p)
+	}
+	if b.buf.Len()+len(p) <= b.limit {
+		return b.buf.Write(p)
+	}
+
+	b.streaming = true
+	b.w.WriteHeader(b.status)
+	if _, err := b.w.Write(b.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	b.buf = bytes.Buffer{}
+	return b.w.Write(p)
+}
+
+// Close writes buffered body with its length, it has to be called after body was written
+func (b *lengthBufferWriter) Close() error {
+	if b.streaming {
+		return nil
+	}
+	b.w.Header().Set("Content-Length", strconv.Itoa(b.buf.Len()))
+	b.w.WriteHeader(b.status)
+	_, err := b.w.Write(b.buf.Bytes())
+	return err
+}
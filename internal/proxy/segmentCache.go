@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+const (
+	// segmentTTLFactor is number of target durations segment stays cached, live playlists keep at least 3 segments
+	segmentTTLFactor = 3
+	// segmentSweepInterval is how often expired segment urls are removed from registry
+	segmentSweepInterval = time.Minute
+)
+
+// cachedSegment is HLS segment body with provider headers
+type cachedSegment struct {
+	key     string
+	header  http.Header
+	body    []byte
+	modTime time.Time
+	expires time.Time
+}
+
+// segmentCache is LRU cache of HLS segments bounded by size of their bodies.
+// Only urls found in media playlists are cached, they are registered by playlist rewriter
+// with ttl derived from target duration of playlist.
+type segmentCache struct {
+	mu        sync.Mutex
+	size      int64
+	lru       *list.List
+	entries   map[string]*list.Element
+	known     map[string]knownSegment
+	lastSweep time.Time
+	flights   flightGroup
+}
+
+type knownSegment struct {
+	ttl     time.Duration
+	expires time.Time
+}
+
+var segments = &segmentCache{
+	lru:     list.New(),
+	entries: make(map[string]*list.Element),
+	known:   make(map[string]knownSegment),
+}
+var onceSegmentCache sync.Once
+
+// getSegmentCache returns segment cache, nil when it is disabled
+func getSegmentCache() *segmentCache {
+	onceSegmentCache.Do(func() {
+		config.OnChange(func(old, new config.Config) {
+			segments.trim(int64(new.Server.SegmentCache.Size))
+		})
+	})
+	if config.GetConfig().Server.SegmentCache.Size <= 0 {
+		return nil
+	}
+	return segments
+}
+
+// register marks url as segment of media playlist, it is cacheable until it disappears from playlist for ttl
+func (c *segmentCache) register(key string, ttl time.Duration) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.known[key] = knownSegment{ttl: ttl, expires: now.Add(ttl)}
+	if now.Sub(c.lastSweep) < segmentSweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for k, s := range c.known {
+		if now.After(s.expires) {
+			delete(c.known, k)
+		}
+	}
+}
+
+func (c *segmentCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.known, key)
+}
+
+// ttl returns how long registered segment can be cached
+func (c *segmentCache) ttl(key string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.known[key]
+	return s.ttl, ok
+}
+
+func (c *segmentCache) get(key string) (*cachedSegment, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	seg := e.Value.(*cachedSegment)
+	if time.Now().After(seg.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return seg, true
+}
+
+// store adds segment and evicts least recently used ones over maxSize
+func (c *segmentCache) store(seg *cachedSegment, maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[seg.key]; ok {
+		c.remove(e)
+	}
+	c.entries[seg.key] = c.lru.PushFront(seg)
+	c.size += int64(len(seg.body))
+	c.evict(maxSize)
+}
+
+func (c *segmentCache) trim(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict(maxSize)
+}
+
+func (c *segmentCache) evict(maxSize int64) {
+	for c.size > maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *segmentCache) remove(e *list.Element) {
+	seg := c.lru.Remove(e).(*cachedSegment)
+	delete(c.entries, seg.key)
+	c.size -= int64(len(seg.body))
+}
+
+// segmentKey normalizes real url the same way proxy urls are converted back to real ones
+func segmentKey(realURL string) string {
+	u, err := url.Parse(realURL)
+	if err != nil {
+		return realURL
+	}
+	u.RawQuery = u.Query().Encode()
+	key, _ := url.QueryUnescape(u.String())
+	return key
+}
+
+// errSegmentTooLarge is returned by fetch of segment over size limit, its request is proxied as usual
+var errSegmentTooLarge = errors.New("Segment is too large")
+
+// serveCachedSegment serves known HLS segment from cache, concurrent misses of the same segment
+// are fetched from provider only once. Returns false when request has to be proxied as usual.
+// Range requests are always proxied, so byte ranges of big files aren't fetched whole.
+func serveCachedSegment(w http.ResponseWriter, r *http.Request, realURL, listName string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || r.Header.Get("Range") != "" {
+		return false
+	}
+	c := getSegmentCache()
+	if c == nil {
+		return false
+	}
+	key := segmentKey(realURL)
+	ttl, ok := c.ttl(key)
+	if !ok {
+		return false
+	}
+
+	seg, hit := c.get(key)
+	if !hit {
+		// fetch can outlive request which started it, so it gets its own copy
+		fetchReq := r.Clone(context.Background())
+		v, err := c.flights.do(r.Context(), key, func() (interface{}, error) {
+			return fetchSegment(fetchReq, realURL, listName, key, ttl)
+		})
+		if r.Context().Err() != nil {
+			// client is gone
+			return true
+		}
+		if err != nil {
+			logger.Debug("Segment not cached (" + err.Error() + "): " + realURL)
+			// answer of provider is shared by all waiters, so failing segment isn't fetched again by each of them
+			var openErr *circuitOpenError
+			var fetchErr *segmentFetchError
+			switch {
+			case errors.As(err, &openErr):
+				writeCircuitOpen(w, openErr.retryAfter)
+				return true
+			case errors.As(err, &fetchErr):
+				fetchErr.write(w, r, realURL, listName)
+				return true
+			}
+			return false
+		}
+		seg = v.(*cachedSegment)
+	}
+
+	logger.Debug("Serving cached segment: " + realURL)
+	copyResponseHeaders(w.Header(), seg.header, listName, false)
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	http.ServeContent(w, r, "", seg.modTime, bytes.NewReader(seg.body))
+	return true
+}
+
+// fetchSegment downloads segment holding connection slot of viewer who requested it first and stores it in cache
+func fetchSegment(r *http.Request, realURL, listName, key string, ttl time.Duration) (*cachedSegment, error) {
+	maxSegmentSize := int64(config.GetConfig().Server.SegmentCache.MaxSegmentSize)
+
+	releaseConnection, err := acquireListConnection(r, listName, realURL)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseConnection()
+
+	req, err := http.NewRequest(http.MethodGet, realURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setUpstreamHeaders(req, r, listName)
+	client, err := GetListClient(listName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, errCircuitOpen) {
+			return nil, err
+		}
+		return nil, &segmentFetchError{status: http.StatusBadGateway, err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &segmentFetchError{status: resp.StatusCode, location: resp.Header.Get("location")}
+	}
+	if _, err := decodeResponseBody(resp); err != nil {
+		return nil, &segmentFetchError{status: http.StatusBadGateway, err: err}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSegmentSize+1))
+	if err != nil {
+		return nil, &segmentFetchError{status: http.StatusBadGateway, err: err}
+	}
+
+	if int64(len(body)) > maxSegmentSize {
+		// oversized segment isn't buffered, it and next requests of it are proxied as usual
+		segments.forget(key)
+		logger.Debug("Segment is bigger than " + strconv.FormatInt(maxSegmentSize, 10) + " bytes, not cached: " + realURL)
+		return nil, errSegmentTooLarge
+	}
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Time{}
+	}
+	seg := &cachedSegment{key: key, header: resp.Header, body: body, modTime: modTime, expires: time.Now().Add(ttl)}
+	segments.store(seg, int64(config.GetConfig().Server.SegmentCache.Size))
+	logger.Debug("Segment cached: " + realURL)
+
+	return seg, nil
+}
+
+// segmentFetchError is failed fetch of segment, it is answered to all requests waiting for the fetch
+type segmentFetchError struct {
+	status   int
+	location string
+	err      error
+}
+
+func (e *segmentFetchError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return "Unexpected status " + strconv.Itoa(e.status)
+}
+
+func (e *segmentFetchError) Unwrap() error {
+	return e.err
+}
+
+// write responds with status of failed fetch, redirect location is converted to proxy url
+func (e *segmentFetchError) write(w http.ResponseWriter, r *http.Request, realURL, listName string) {
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	if e.location != "" {
+		location := e.location
+		if u, err := url.Parse(realURL); err == nil {
+			if locationURL, err := u.Parse(location); err == nil {
+				location = locationURL.String()
+			}
+		}
+		proxyLocation, err := convertLocation(r, location, realURL, listName)
+		if err != nil {
+			logger.Warn("Unable to convert location header: " + location)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("location", proxyLocation)
+	}
+	w.WriteHeader(e.status)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/mpegts"
+)
+
+var errSegmentNotFound = errors.New("Segment not found")
+
+// segmentStore keeps segments produced by repackager of channel
+type segmentStore interface {
+	// add appends segment, oldest segments over store window are dropped
+	add(seg mpegts.Segment) error
+	// segments returns stored segments from the oldest and discontinuity sequence number of the first one
+	segments() ([]storedSegment, int)
+	// open returns body of segment with sequence number
+	open(seq int) (io.ReadSeekCloser, error)
+	// close drops all segments
+	close() error
+}
+
+// storedSegment describes segment of store
+type storedSegment struct {
+	seq           int
+	duration      time.Duration
+	discontinuity bool
+	size          int64
+	created       time.Time
+}
+
+// memorySegmentStore keeps fixed number of latest segments in memory
+type memorySegmentStore struct {
+	mu               sync.Mutex
+	max              int
+	infos            []storedSegment
+	bodies           [][]byte
+	nextSeq          int
+	discontinuitySeq int
+}
+
+func newMemorySegmentStore(max int) *memorySegmentStore {
+	return &memorySegmentStore{max: max}
+}
+
+func (s *memorySegmentStore) add(seg mpegts.Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infos = append(s.infos, storedSegment{
+		seq:           s.nextSeq,
+		duration:      seg.Duration,
+		discontinuity: seg.Discontinuity,
+		size:          int64(len(seg.Data)),
+		created:       time.Now(),
+	})
+	s.bodies = append(s.bodies, seg.Data)
+	s.nextSeq++
+	for len(s.infos) > s.max {
+		if s.infos[0].discontinuity {
+			s.discontinuitySeq++
+		}
+		s.infos = s.infos[1:]
+		s.bodies[0] = nil
+		s.bodies = s.bodies[1:]
+	}
+	return nil
+}
+
+func (s *memorySegmentStore) segments() ([]storedSegment, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]storedSegment(nil), s.infos...), s.discontinuitySeq
+}
+
+func (s *memorySegmentStore) open(seq int) (io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.infos) == 0 {
+		return nil, errSegmentNotFound
+	}
+	i := seq - s.infos[0].seq
+	if i < 0 || i >= len(s.infos) {
+		return nil, errSegmentNotFound
+	}
+	return nopReadSeekCloser{bytes.NewReader(s.bodies[i])}, nil
+}
+
+func (s *memorySegmentStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infos = nil
+	s.bodies = nil
+	return nil
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
@@ -1,30 +1,153 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
-	"strconv"
+	"net/url"
+	"sync"
 
 	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
 
 	"github.com/gorilla/mux"
 )
 
-// InitServer starting http server
-func InitServer() {
+var shutdownHooks []func()
+var shutdownHooksMu sync.Mutex
+
+// OnShutdown registers function called after server stopped, used to flush state to disk
+func OnShutdown(f func()) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// InitServer starting http server and optional https server, it runs until ctx is canceled or server fails.
+// Then it stops accepting connections, waits server.shutdownTimeout for active streams to finish,
+// cancels the rest including their upstream requests and runs shutdown hooks.
+func InitServer(ctx context.Context) error {
+	if err := StartRecordings(); err != nil {
+		return err
+	}
+
+	StartProbes()
+
 	r := mux.NewRouter()
 	r.HandleFunc("/list/{name}", handleListRequest).Queries("token", "{token}").Name("list")
+	r.HandleFunc("/hls/{list}/{channel}.m3u8", handleHLSPlaylist).Queries("token", "{token}").Name("hlsPlaylist")
+	r.HandleFunc("/hls/{list}/{channel}/{seq:[0-9]+}.ts", handleHLSSegment).Queries("token", "{token}").Name("hlsSegment")
+	r.HandleFunc("/dvr/{list}/{channel}.m3u8", handleDVRPlaylist).Queries("token", "{token}").Name("dvrPlaylist")
+	r.HandleFunc("/dvr/{list}/{channel}/{seq:[0-9]+}.ts", handleDVRSegment).Queries("token", "{token}").Name("dvrSegment")
+	r.HandleFunc("/ts/{list}/{channel}.ts", handleTSStream).Queries("token", "{token}").Name("tsStream")
+	r.HandleFunc("/api/recordings/{list}", handleRecordingsRequest).Queries("token", "{token}").Name("recordings")
+	r.HandleFunc("/api/recordings/{list}/{id}", handleRecordingRequest).Queries("token", "{token}").Name("recording")
+	r.HandleFunc("/api/programmes/{list}/{channel}", handleProgrammesRequest).Queries("token", "{token}").Name("programmes")
+	r.HandleFunc("/recordings/{list}/{id}.m3u8", handleRecordingPlaylist).Queries("token", "{token}").Name("recordingPlaylist")
+	r.HandleFunc("/recordings/{list}/{id}.ts", handleRecordingFile).Queries("token", "{token}").Name("recordingFile")
+	r.HandleFunc("/api/health/{list}", handleHealthRequest).Queries("token", "{token}").Name("health")
+	r.HandleFunc("/catchup/{list}/{source}", handleCatchupRequest).Name("catchup")
+	r.HandleFunc("/metrics", handleMetricsRequest).Name("metrics")
 	r.HandleFunc("/robots.txt", handleRobots).Name("robots")
-	r.NotFoundHandler = http.HandlerFunc(handleProxyRequest)
+	r.NotFoundHandler = corsMiddleware(http.HandlerFunc(handleProxyRequest))
+	r.Use(corsMiddleware)
+
+	// requests context is canceled when drain period is over, which aborts upstream requests
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 
 	c := config.GetConfig()
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":" + strconv.Itoa(c.Server.Port),
+	servers := []*http.Server{}
+	var plainHandler http.Handler = r
+	if c.Server.TLS.Enabled {
+		tlsConfig, err := getTLSConfig()
+		if err != nil {
+			return err
+		}
+		servers = append(servers, newServer(r, config.GetTLSListenAddress(), requestsCtx))
+		servers[0].TLSConfig = tlsConfig
+
+		if c.Server.TLS.RedirectHTTP {
+			plainHandler = http.HandlerFunc(handleHTTPSRedirect)
+		} else if appURL, err := url.Parse(c.App.URL); err == nil && appURL.Scheme != "https" {
+			logger.Warn("TLS is enabled but app.url " + c.App.URL + " uses http, playlists will point clients to plain http")
+		}
+	}
+	servers = append(servers, newServer(plainHandler, config.GetListenAddress(), requestsCtx))
+
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				serveErr <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			serveErr <- srv.ListenAndServe()
+		}(srv)
+		if srv.TLSConfig != nil {
+			logger.Info("Listening on " + srv.Addr + " (https)")
+		} else {
+			logger.Info("Listening on " + srv.Addr)
+		}
+	}
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+	}
+
+	drainTimeout := config.GetConfig().Server.ShutdownTimeout
+	if err == nil {
+		logger.Info("Shutting down, waiting " + drainTimeout.String() + " for active connections")
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	shutdownServers(drainCtx, servers, cancelRequests)
+
+	shutdownHooksMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooksMu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	logger.Info("Server stopped")
+
+	return err
+}
+
+func newServer(handler http.Handler, addr string, requestsCtx context.Context) *http.Server {
+	c := config.GetConfig()
+	return &http.Server{
+		Handler:      handler,
+		Addr:         addr,
 		WriteTimeout: c.Server.WriteTimeout,
 		ReadTimeout:  c.Server.ReadTimeout,
 		IdleTimeout:  c.Server.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return requestsCtx
+		},
 	}
-	if err := srv.ListenAndServe(); err != nil {
-		panic(err)
+}
+
+// shutdownServers gracefully stops servers, after drainCtx is done remaining requests are canceled
+func shutdownServers(drainCtx context.Context, servers []*http.Server, cancelRequests func()) {
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(drainCtx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Warn("Drain period is over, closing remaining connections of " + srv.Addr)
+				cancelRequests()
+				err = srv.Close()
+			}
+			if err != nil {
+				logger.Error("Server shutdown failed: " + err.Error())
+			}
+		}(srv)
 	}
+	wg.Wait()
 }
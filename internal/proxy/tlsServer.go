@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves certificate from files and reloads it when files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = cr.filesModTime()
+	return nil
+}
+
+// filesModTime returns latest modification time of cert and key files
+func (cr *certReloader) filesModTime() time.Time {
+	latest := time.Time{}
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate returns current certificate, files are checked for change at most every certCheckInterval
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.checkedAt) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checkedAt = time.Now()
+	if !cr.filesModTime().After(cr.modTime) {
+		return cr.cert, nil
+	}
+	if err := cr.load(); err != nil {
+		// keep serving old certificate until files are complete
+		logger.Error("Unable to reload certificate: " + err.Error())
+		return cr.cert, nil
+	}
+	logger.Info("Certificate reloaded from " + cr.certFile)
+
+	return cr.cert, nil
+}
+
+// getTLSConfig returns tls config with certificate from files or self signed one
+func getTLSConfig() (*tls.Config, error) {
+	t := config.GetConfig().Server.TLS
+
+	if t.SelfSigned && (t.CertFile == "" || !fileExists(t.CertFile) || !fileExists(t.KeyFile)) {
+		certPEM, keyPEM, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		if t.CertFile == "" {
+			logger.Warn("Using self signed certificate generated in memory, it changes on every restart")
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+		}
+		if err := os.WriteFile(t.CertFile, certPEM, 0644); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(t.KeyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		logger.Info("Self signed certificate written to " + t.CertFile)
+	}
+
+	cr, err := newCertReloader(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: cr.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+}
+
+// generateSelfSignedCert creates certificate valid for host of app url, localhost and loopback addresses
+func generateSelfSignedCert() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"iptv-proxy"}, CommonName: "iptv-proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if appURL, err := url.Parse(config.GetConfig().App.URL); err == nil && appURL.Hostname() != "" {
+		if ip := net.ParseIP(appURL.Hostname()); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, appURL.Hostname())
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// handleHTTPSRedirect redirects plain http requests to https server
+func handleHTTPSRedirect(w http.ResponseWriter, r *http.Request) {
+	target, err := httpsURL(r)
+	if err != nil {
+		logger.Warn(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow, nosnippet")
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
+
+// httpsURL returns url of request on https server, app.url is required to be https when redirect is enabled
+func httpsURL(r *http.Request) (string, error) {
+	appURL, err := url.Parse(config.GetConfig().App.URL)
+	if err != nil {
+		return "", err
+	}
+	return "https://" + appURL.Host + r.URL.RequestURI(), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
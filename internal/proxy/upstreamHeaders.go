@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+)
+
+// setUpstreamHeaders sets headers of request to provider according to list config.
+// Client request can be nil for requests made by proxy itself.
+func setUpstreamHeaders(req *http.Request, clientReq *http.Request, listName string) {
+	list, err := config.GetListFromConfig(listName)
+	if err != nil {
+		return
+	}
+	h := list.Headers
+
+	if clientReq != nil {
+		for _, name := range h.Passthrough {
+			for _, value := range clientReq.Header.Values(name) {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+	if h.UserAgent != "" {
+		req.Header.Set("User-Agent", expandHeaderTemplate(h.UserAgent, clientReq, listName))
+	}
+	for _, cookie := range list.Cookies.Values {
+		pair := strings.SplitN(cookie, "=", 2)
+		if len(pair) == 2 {
+			req.AddCookie(&http.Cookie{Name: pair[0], Value: pair[1]})
+		}
+	}
+	for name, value := range h.Set {
+		value = expandHeaderTemplate(value, clientReq, listName)
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		req.Header.Add(name, expandHeaderTemplate(value, clientReq, listName))
+	}
+	for _, name := range h.Remove {
+		req.Header.Del(name)
+	}
+	// empty value stops http client from sending its default user agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// expandHeaderTemplate replaces {client_ip}, {user_agent} and {list} placeholders
+func expandHeaderTemplate(value string, clientReq *http.Request, listName string) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	ip, userAgent := "", ""
+	if clientReq != nil {
+		ip = clientIP(clientReq)
+		userAgent = clientReq.Header.Get("User-Agent")
+	}
+	return strings.NewReplacer(
+		"{client_ip}", ip,
+		"{user_agent}", userAgent,
+		"{list}", listName,
+	).Replace(value)
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
+)
+
+// variantFilter decides which variants of HLS master playlist are listed for client
+type variantFilter struct {
+	config.VariantFilter
+	maxWidth  int
+	maxHeight int
+	// key identifies filter in keys of shared manifests
+	key string
+}
+
+// pendingVariant is rewritten #EXT-X-STREAM-INF tag with its uri line held until whole master playlist is read
+type pendingVariant struct {
+	data      []byte
+	bandwidth int
+	// pixels is width times height of resolution, 0 when variant has none
+	pixels  int
+	allowed bool
+	// codecsAllowed reports if variant passes codecs of filter, nearest variant is chosen only of them
+	codecsAllowed bool
+}
+
+// clientVariantFilter returns variant filter of list for client of request, nil when list doesn't filter variants
+func clientVariantFilter(r *http.Request, listName string) *variantFilter {
+	list, err := config.GetListFromConfig(listName)
+	if err != nil {
+		return nil
+	}
+
+	f := list.Variants.VariantFilter
+	key := "list"
+	for i, profile := range list.Variants.Profiles {
+		if matchVariantProfile(r, profile) {
+			f = profile.VariantFilter
+			key = "profile" + strconv.Itoa(i)
+			break
+		}
+	}
+	if f.MaxBandwidth == 0 && f.MaxResolution == "" && len(f.Codecs) == 0 && f.Single == "" {
+		return nil
+	}
+
+	vf := &variantFilter{VariantFilter: f, key: key}
+	if f.MaxResolution != "" {
+		vf.maxWidth, vf.maxHeight, _ = config.ParseResolution(f.MaxResolution)
+	}
+	return vf
+}
+
+func matchVariantProfile(r *http.Request, profile config.VariantProfile) bool {
+	if len(profile.Clients) > 0 {
+		ip := net.ParseIP(clientIP(r))
+		matched := false
+		for _, c := range profile.Clients {
+			if network, err := config.ParseClientNetwork(c); err == nil && ip != nil && network.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(profile.UserAgents) > 0 {
+		userAgent := strings.ToLower(r.Header.Get("user-agent"))
+		for _, ua := range profile.UserAgents {
+			if strings.Contains(userAgent, strings.ToLower(ua)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// allows reports if variant with attributes of #EXT-X-STREAM-INF passes limits of filter, missing attributes pass
+func (f *variantFilter) allows(attrs map[string]string) bool {
+	if f.MaxBandwidth > 0 {
+		if bandwidth, err := strconv.Atoi(attrs["BANDWIDTH"]); err == nil && bandwidth > f.MaxBandwidth {
+			return false
+		}
+	}
+	if f.maxWidth > 0 && attrs["RESOLUTION"] != "" {
+		if width, height, err := config.ParseResolution(attrs["RESOLUTION"]); err == nil && (width > f.maxWidth || height > f.maxHeight) {
+			return false
+		}
+	}
+	return f.allowsCodecs(attrs)
+}
+
+// allowsCodecs reports if all codecs of variant are allowed, variant without CODECS attribute passes
+func (f *variantFilter) allowsCodecs(attrs map[string]string) bool {
+	if len(f.Codecs) > 0 && attrs["CODECS"] != "" {
+		for _, codec := range strings.Split(attrs["CODECS"], ",") {
+			if !f.allowsCodec(strings.TrimSpace(codec)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *variantFilter) allowsCodec(codec string) bool {
+	for _, prefix := range f.Codecs {
+		if len(codec) >= len(prefix) && strings.EqualFold(codec[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// choose returns variants which are listed, when none passes the filter the lowest one is kept so playlist stays playable
+func (f *variantFilter) choose(variants []pendingVariant) []pendingVariant {
+	if len(variants) == 0 {
+		return variants
+	}
+	if f.Single == "nearest" {
+		return []pendingVariant{f.nearestVariant(variants)}
+	}
+
+	chosen := make([]pendingVariant, 0, len(variants))
+	for _, v := range variants {
+		if v.allowed {
+			chosen = append(chosen, v)
+		}
+	}
+	if len(chosen) == 0 {
+		logger.Debug("No variant passes filter, keeping the lowest one")
+		chosen = append(chosen, extremeVariant(variants, false))
+	}
+
+	switch f.Single {
+	case "highest":
+		return []pendingVariant{extremeVariant(chosen, true)}
+	case "lowest":
+		return []pendingVariant{extremeVariant(chosen, false)}
+	}
+	return chosen
+}
+
+// extremeVariant returns variant with the highest or the lowest bandwidth
+func extremeVariant(variants []pendingVariant, highest bool) pendingVariant {
+	best := variants[0]
+	for _, v := range variants[1:] {
+		if (highest && v.bandwidth > best.bandwidth) || (!highest && v.bandwidth < best.bandwidth) {
+			best = v
+		}
+	}
+	return best
+}
+
+// nearestVariant returns variant with resolution and bandwidth nearest to limits of filter, even when it is above them.
+// Resolution is compared first, variants of the same distance are ordered by bandwidth, the lower one wins ties.
+func (f *variantFilter) nearestVariant(variants []pendingVariant) pendingVariant {
+	candidates := make([]pendingVariant, 0, len(variants))
+	for _, v := range variants {
+		if v.codecsAllowed {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = variants
+	}
+
+	maxPixels := f.maxWidth * f.maxHeight
+	distance := func(v pendingVariant) (int, int) {
+		resolution, bandwidth := 0, 0
+		if maxPixels > 0 {
+			resolution = math.MaxInt
+			if v.pixels > 0 {
+				resolution = abs(v.pixels - maxPixels)
+			}
+		}
+		if f.MaxBandwidth > 0 {
+			bandwidth = abs(v.bandwidth - f.MaxBandwidth)
+		}
+		return resolution, bandwidth
+	}
+
+	best := candidates[0]
+	bestResolution, bestBandwidth := distance(best)
+	for _, v := range candidates[1:] {
+		resolution, bandwidth := distance(v)
+		if resolution < bestResolution ||
+			resolution == bestResolution && (bandwidth < bestBandwidth || bandwidth == bestBandwidth && v.bandwidth < best.bandwidth) {
+			best, bestResolution, bestBandwidth = v, resolution, bandwidth
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nortoneo/iptv-proxy/internal/config"
+)
+
+// testVariant returns allowed variant of bandwidth and resolution, resolution 0x0 means variant has none
+func testVariant(bandwidth, width, height int) pendingVariant {
+	return pendingVariant{bandwidth: bandwidth, pixels: width * height, allowed: true, codecsAllowed: true}
+}
+
+func blocked(v pendingVariant) pendingVariant {
+	v.allowed = false
+	return v
+}
+
+func bandwidths(variants []pendingVariant) []int {
+	b := make([]int, 0, len(variants))
+	for _, v := range variants {
+		b = append(b, v.bandwidth)
+	}
+	return b
+}
+
+func TestVariantFilterAllows(t *testing.T) {
+	f := &variantFilter{
+		VariantFilter: config.VariantFilter{MaxBandwidth: 3000000, Codecs: []string{"avc1", "mp4a"}},
+		maxWidth:      1280,
+		maxHeight:     720,
+	}
+	tests := []struct {
+		name  string
+		attrs map[string]string
+		want  bool
+	}{
+		{name: "within limits", attrs: map[string]string{"BANDWIDTH": "2000000", "RESOLUTION": "1280x720", "CODECS": "avc1.4d401f,mp4a.40.2"}, want: true},
+		{name: "missing attributes", attrs: map[string]string{}, want: true},
+		{name: "bandwidth above", attrs: map[string]string{"BANDWIDTH": "3000001"}},
+		{name: "width above", attrs: map[string]string{"RESOLUTION": "1920x720"}},
+		{name: "height above", attrs: map[string]string{"RESOLUTION": "1280x1080"}},
+		{name: "codec case insensitive", attrs: map[string]string{"CODECS": "AVC1.640028, MP4A.40.2"}, want: true},
+		{name: "codec not allowed", attrs: map[string]string{"CODECS": "hvc1.1.6.L93.B0,mp4a.40.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.allows(tt.attrs); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantFilterChoose(t *testing.T) {
+	low := testVariant(800000, 640, 360)
+	mid := testVariant(2500000, 1280, 720)
+	high := testVariant(5000000, 1920, 1080)
+	tests := []struct {
+		name     string
+		filter   variantFilter
+		variants []pendingVariant
+		want     []int
+	}{
+		{name: "no variants", variants: []pendingVariant{}, want: []int{}},
+		{name: "allowed variants", variants: []pendingVariant{blocked(high), mid, low}, want: []int{2500000, 800000}},
+		{name: "none allowed keeps lowest", variants: []pendingVariant{blocked(high), blocked(mid)}, want: []int{2500000}},
+		{name: "highest allowed", filter: variantFilter{VariantFilter: config.VariantFilter{Single: "highest"}}, want: []int{2500000}},
+		{name: "lowest allowed", filter: variantFilter{VariantFilter: config.VariantFilter{Single: "lowest"}}, want: []int{800000}},
+		{
+			name:     "nearest ignores allowed",
+			filter:   variantFilter{VariantFilter: config.VariantFilter{Single: "nearest", MaxBandwidth: 4500000}},
+			variants: []pendingVariant{low, mid, blocked(high)},
+			want:     []int{5000000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants := tt.variants
+			if variants == nil {
+				variants = []pendingVariant{low, mid, blocked(high)}
+			}
+			if got := bandwidths(tt.filter.choose(variants)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNearestVariant(t *testing.T) {
+	hd := variantFilter{maxWidth: 1280, maxHeight: 720}
+	tests := []struct {
+		name     string
+		filter   variantFilter
+		variants []pendingVariant
+		want     int
+	}{
+		{
+			name:     "nearest resolution below",
+			filter:   hd,
+			variants: []pendingVariant{testVariant(1, 960, 540), testVariant(2, 1600, 900)},
+			want:     1,
+		},
+		{
+			name:     "nearest resolution above",
+			filter:   hd,
+			variants: []pendingVariant{testVariant(1, 640, 360), testVariant(2, 1366, 768)},
+			want:     2,
+		},
+		{
+			name:     "variant without resolution is the farthest",
+			filter:   hd,
+			variants: []pendingVariant{testVariant(1, 0, 0), testVariant(2, 3840, 2160)},
+			want:     2,
+		},
+		{
+			name:     "nearest bandwidth",
+			filter:   variantFilter{VariantFilter: config.VariantFilter{MaxBandwidth: 3000000}},
+			variants: []pendingVariant{testVariant(1000000, 0, 0), testVariant(4000000, 0, 0), testVariant(2500000, 0, 0)},
+			want:     2500000,
+		},
+		{
+			name:     "lower bandwidth wins tie",
+			filter:   variantFilter{VariantFilter: config.VariantFilter{MaxBandwidth: 3000000}},
+			variants: []pendingVariant{testVariant(4000000, 0, 0), testVariant(2000000, 0, 0)},
+			want:     2000000,
+		},
+		{
+			name:     "bandwidth orders the same resolution",
+			filter:   variantFilter{VariantFilter: config.VariantFilter{MaxBandwidth: 3000000}, maxWidth: 1280, maxHeight: 720},
+			variants: []pendingVariant{testVariant(5000000, 1280, 720), testVariant(2800000, 1280, 720), testVariant(3000000, 1920, 1080)},
+			want:     2800000,
+		},
+		{
+			name:   "variants of allowed codecs first",
+			filter: hd,
+			variants: []pendingVariant{
+				{bandwidth: 1, pixels: 1280 * 720},
+				{bandwidth: 2, pixels: 1920 * 1080, codecsAllowed: true},
+			},
+			want: 2,
+		},
+		{
+			name:     "no allowed codecs",
+			filter:   hd,
+			variants: []pendingVariant{{bandwidth: 1, pixels: 1920 * 1080}, {bandwidth: 2, pixels: 1280 * 720}},
+			want:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.nearestVariant(tt.variants); got.bandwidth != tt.want {
+				t.Errorf("got %d, want %d", got.bandwidth, tt.want)
+			}
+		})
+	}
+}
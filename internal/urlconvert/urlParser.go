@@ -12,12 +12,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 
 	"github.com/nortoneo/iptv-proxy/internal/config"
+	"github.com/nortoneo/iptv-proxy/internal/logger"
 )
 
 const (
@@ -48,56 +48,170 @@ func ConvertPathToProxyPath(path, listName, encURL string) (string, error) {
 
 	uString, _ := url.QueryUnescape(u.String())
 
-	log.Println("Converted: " + path + " to: " + uString)
+	logger.Debug("Converted: " + path + " to: " + uString)
 
 	return uString, nil
 }
 
 // ConvertURLtoProxyURL converts real url to proxy url
 func ConvertURLtoProxyURL(realURL, appURL, listName string) (string, error) {
-	real, err := url.Parse(realURL)
+	c, err := NewURLConverter(appURL, listName)
 	if err != nil {
 		return "", err
 	}
+	return c.Convert(realURL)
+}
+
+// URLConverter converts real urls of one list to proxy urls.
+// Encrypted targets are cached by host, so big playlists don't encrypt the same host for every url.
+type URLConverter struct {
+	app      *url.URL
+	listName string
+	stream   string
+	base     *url.URL
+	targets  map[string]string
+}
 
+// NewURLConverter returns converter of list urls to proxy urls under app url
+func NewURLConverter(appURL, listName string) (*URLConverter, error) {
 	app, err := url.Parse(appURL)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return &URLConverter{app: app, listName: listName, targets: make(map[string]string)}, nil
+}
 
-	//encoding real host path
-	encURL := real.Scheme
-	encURL += "://"
-	if real.User.String() != "" {
-		encURL += real.User.String() + "@"
-	}
-	encURL += real.Host
+// SetStream sets lineage bound to targets of converted urls, empty stream binds none.
+// Base is real url relative paths are resolved against, the same way player resolves them against proxy url.
+func (c *URLConverter) SetStream(stream string, base *url.URL) {
+	c.stream = stream
+	c.base = base
+}
 
-	key := config.GetConfig().App.EncryptionKey
-	token, _ := config.GetListToken(listName)
-	key += token
+// ConvertPath converts path to proxy path, encURL is target the path is relative to
+func (c *URLConverter) ConvertPath(path, encURL string) (string, error) {
+	if c.stream == "" || c.base == nil {
+		return ConvertPathToProxyPath(path, c.listName, encURL)
+	}
+	real, err := c.base.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	encURL, err = encryptTarget(streamTarget(real, c.stream), c.listName)
+	if err != nil {
+		return "", err
+	}
+	return ConvertPathToProxyPath(path, c.listName, encURL)
+}
 
-	encURL, err = Encode(encURL, key)
+// Convert converts real url to proxy url
+func (c *URLConverter) Convert(realURL string) (string, error) {
+	real, err := url.Parse(realURL)
 	if err != nil {
 		return "", err
 	}
 
+	var encURL string
+	if c.stream != "" {
+		// target bound to stream is valid only for this url, it isn't cached
+		encURL, err = encryptTarget(streamTarget(real, c.stream), c.listName)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		target := targetOf(real)
+		var ok bool
+		if encURL, ok = c.targets[target]; !ok {
+			encURL, err = encryptTarget(target, c.listName)
+			if err != nil {
+				return "", err
+			}
+			c.targets[target] = encURL
+		}
+	}
+
 	//overriding to proxy
-	real.Scheme = app.Scheme
-	real.Host = app.Host
-	real.User = app.User
+	real.Scheme = c.app.Scheme
+	real.Host = c.app.Host
+	real.User = c.app.User
 	q := real.Query()
-	q.Set(GetParamList(), listName)
+	q.Set(GetParamList(), c.listName)
 	q.Set(GetParamEncTarget(), encURL)
 	real.RawQuery = q.Encode()
 
 	proxyURLString, _ := url.QueryUnescape(real.String())
 
-	log.Println("Converted: " + realURL + " to: " + proxyURLString)
+	logger.Debug("Converted: " + realURL + " to: " + proxyURLString)
 
 	return proxyURLString, nil
 }
 
+// EncodeTarget returns encrypted scheme, user and host of real url, used as target param of proxy urls
+func EncodeTarget(realURL, listName string) (string, error) {
+	real, err := url.Parse(realURL)
+	if err != nil {
+		return "", err
+	}
+	return encodeTarget(real, listName)
+}
+
+func encodeTarget(real *url.URL, listName string) (string, error) {
+	return encryptTarget(targetOf(real), listName)
+}
+
+// streamTarget returns target bound to path of real url and lineage of HLS stream, lineage is stored as fragment
+func streamTarget(real *url.URL, stream string) string {
+	return targetOf(real) + real.EscapedPath() + "#" + stream
+}
+
+// StreamOfRequest returns lineage of HLS stream bound to target of proxy request,
+// it is empty when target has none or it was bound to other path
+func StreamOfRequest(r *http.Request) string {
+	q := r.URL.Query()
+	target, err := DecodeForList(q.Get(paramEncTarget), q.Get(paramList))
+	if err != nil {
+		return ""
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Fragment == "" || u.Path != r.URL.Path {
+		return ""
+	}
+	return u.Fragment
+}
+
+// targetOf returns scheme, user and host part of url
+func targetOf(real *url.URL) string {
+	target := real.Scheme
+	target += "://"
+	if real.User.String() != "" {
+		target += real.User.String() + "@"
+	}
+	target += real.Host
+	return target
+}
+
+func encryptTarget(target, listName string) (string, error) {
+	key := config.GetConfig().App.EncryptionKey
+	token, _ := config.GetListToken(listName)
+	key += token
+
+	return Encode(target, key)
+}
+
+// EncodeForList encodes text with key of list, used for values of proxy urls other than targets
+func EncodeForList(text, listName string) (string, error) {
+	return encryptTarget(text, listName)
+}
+
+// DecodeForList decodes text encoded by EncodeForList
+func DecodeForList(encoded, listName string) (string, error) {
+	token, err := config.GetListToken(listName)
+	if err != nil {
+		return "", err
+	}
+	return Decode(encoded, config.GetConfig().App.EncryptionKey+token)
+}
+
 // ConvertProxyRequestToURL converts request to target url string
 func ConvertProxyRequestToURL(r *http.Request) (string, string, error) {
 	appURL, err := url.Parse(config.GetConfig().App.URL)
@@ -157,7 +271,7 @@ func ConvertProxyURLtoURL(proxyURL string) (string, string, error) {
 	pURL.User = realURL.User
 
 	urlString, _ := url.QueryUnescape(pURL.String())
-	log.Println("Converted: " + proxyURL + " to: " + urlString)
+	logger.Debug("Converted: " + proxyURL + " to: " + urlString)
 
 	return urlString, listName, nil
 }
@@ -258,6 +372,9 @@ func decrypt(encryptedString string, keyString string) (string, error) {
 	}
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return "", errors.New("Encrypted text is too short")
+	}
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
 	//Decrypt the data